@@ -0,0 +1,12 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build go1.20
+
+package shutdown
+
+import "context"
+
+// contextCause returns the cause of the cancellation of ctx.
+func contextCause(ctx context.Context) error {
+	return context.Cause(ctx)
+}
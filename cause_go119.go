@@ -0,0 +1,12 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build !go1.20
+
+package shutdown
+
+import "context"
+
+// contextCause returns the error of ctx, since causes are not supported before Go 1.20.
+func contextCause(ctx context.Context) error {
+	return ctx.Err()
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build go1.20
+
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTriggerContextCause(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	m := New(WithTriggerContext(ctx), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	cancel(errors.New("database lost"))
+	if !m.WaitTimeout(time.Second) {
+		t.Fatal("shutdown did not finish after the context was cancelled")
+	}
+	if got, want := m.ShutdownReason(), "context: database lost"; got != want {
+		t.Errorf("want reason %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"runtime"
+)
+
+// AddChild makes child shut down when m reaches stage s.
+// The stage waits for the shutdown of child to finish, no longer than the timeout of the stage.
+// The child can still be shut down on its own, in which case the stage does not wait.
+// If child is already shutting down, the stage waits for it to finish,
+// whatever is set with WithSecondShutdown on child, so a child created with NewScope
+// does not exit the process if it inherited SecondShutdownExit.
+// If child is m or one of the managers m is a child of, ErrCycle is returned.
+// The returned notifier can be used to cancel the shutdown of the child,
+// after which child no longer counts as a child of m.
+func (m *Manager) AddChild(child *Manager, s Stage) (Notifier, error) {
+	// The parent is locked before its descendants. They are only tried,
+	// since a concurrent call may hold one of them while waiting for m.
+	m.childM.Lock()
+	defer m.childM.Unlock()
+	for {
+		found, ok := child.reaches(m)
+		if found {
+			return Notifier{}, ErrCycle
+		}
+		if ok {
+			break
+		}
+		m.childM.Unlock()
+		runtime.Gosched()
+		m.childM.Lock()
+	}
+	n := m.onFuncCancel(s.n, 1, func(ctx context.Context) {
+		done := make(chan struct{})
+		go func() {
+			child.shutdown("parent shutdown", SecondShutdownWait)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}, func() { m.removeChild(child) }, []interface{}{"child manager"})
+	if n.Valid() {
+		m.children = append(m.children, child)
+	}
+	return n, nil
+}
+
+// removeChild removes child from the children of m.
+func (m *Manager) removeChild(child *Manager) {
+	m.childM.Lock()
+	defer m.childM.Unlock()
+	for i, c := range m.children {
+		if c == child {
+			copy(m.children[i:], m.children[i+1:])
+			m.children[len(m.children)-1] = nil
+			m.children = m.children[:len(m.children)-1]
+			return
+		}
+	}
+}
+
+// reaches returns true if target is m or one of its descendants.
+// ok is false if the children of a descendant were locked by another call,
+// in which case the caller should unlock and try again.
+func (m *Manager) reaches(target *Manager) (found, ok bool) {
+	if m == target {
+		return true, true
+	}
+	if !m.childM.TryLock() {
+		return false, false
+	}
+	children := append([]*Manager(nil), m.children...)
+	m.childM.Unlock()
+	for _, c := range children {
+		if found, ok := c.reaches(target); found || !ok {
+			return found, ok
+		}
+	}
+	return false, true
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"os"
+	"os/exec"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddChild(t *testing.T) {
+	parent := New(WithTimeout(time.Second), WithLogger(nil))
+	child := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(parent, t))
+
+	var mu sync.Mutex
+	var got []string
+	record := func(s string) func() {
+		return func() {
+			mu.Lock()
+			got = append(got, s)
+			mu.Unlock()
+		}
+	}
+	parent.FirstFn(record("parent 1"))
+	parent.ThirdFn(record("parent 3"))
+	child.FirstFn(record("child 1"))
+	child.ThirdFn(record("child 3"))
+	if _, err := parent.AddChild(child, Stage2); err != nil {
+		t.Fatal(err)
+	}
+	parent.Shutdown()
+
+	want := []string{"parent 1", "child 1", "child 3", "parent 3"}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("want %v, got %v", want, got)
+	}
+	if !child.Started() {
+		t.Error("child was not shut down")
+	}
+}
+
+func TestAddChildIndependent(t *testing.T) {
+	parent := New(WithTimeout(time.Second), WithLogger(nil))
+	child := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(parent, t))
+
+	if _, err := parent.AddChild(child, Stage1); err != nil {
+		t.Fatal(err)
+	}
+	child.Shutdown()
+	if parent.Started() {
+		t.Error("shutting down the child should not shut down the parent")
+	}
+	parent.Shutdown()
+}
+
+func TestAddChildCycle(t *testing.T) {
+	a := New(WithLogger(nil))
+	b := New(WithLogger(nil))
+	c := New(WithLogger(nil))
+	if _, err := a.AddChild(a, Stage1); err != ErrCycle {
+		t.Errorf("adding a manager to itself: want ErrCycle, got %v", err)
+	}
+	if _, err := a.AddChild(b, Stage1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.AddChild(c, Stage1); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.AddChild(a, Stage1); err != ErrCycle || n.Valid() {
+		t.Errorf("want ErrCycle and invalid notifier, got %v, %v", err, n.Valid())
+	}
+	if _, err := a.AddChild(c, Stage2); err != nil {
+		t.Errorf("adding a descendant again should be allowed, got %v", err)
+	}
+}
+
+func TestAddChildCancel(t *testing.T) {
+	parent := New(WithLogger(nil))
+	child := New(WithLogger(nil))
+	n, err := parent.AddChild(child, Stage1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Cancel()
+	for i := 0; ; i++ {
+		parent.childM.Lock()
+		left := len(parent.children)
+		parent.childM.Unlock()
+		if left == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("cancelled child was not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := child.AddChild(parent, Stage1); err != nil {
+		t.Errorf("a cancelled child should not cause a cycle, got %v", err)
+	}
+}
+
+func TestAddChildConcurrentCycle(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		a := New(WithLogger(nil))
+		b := New(WithLogger(nil))
+		errs := make(chan error, 2)
+		go func() {
+			_, err := a.AddChild(b, Stage1)
+			errs <- err
+		}()
+		go func() {
+			_, err := b.AddChild(a, Stage1)
+			errs <- err
+		}()
+		var cycles int
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err == ErrCycle {
+				cycles++
+			}
+		}
+		if cycles != 1 {
+			t.Fatalf("want one ErrCycle, got %d", cycles)
+		}
+	}
+}
+
+func TestAddChildSecondShutdownExit(t *testing.T) {
+	if os.Getenv("SHUTDOWN_TEST_CHILD_EXIT") == "1" {
+		parent := New(WithTimeout(time.Second), WithLogger(nil))
+		child := New(WithTimeout(time.Second), WithSecondShutdown(SecondShutdownExit), WithLogger(nil))
+		if _, err := parent.AddChild(child, Stage1); err != nil {
+			os.Exit(2)
+		}
+		release := make(chan struct{})
+		child.FirstFn(func() { <-release })
+		go child.Shutdown()
+		for !child.Started() {
+			time.Sleep(time.Millisecond)
+		}
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		// The parent waits for the running shutdown of the child, without exiting.
+		parent.Shutdown()
+		os.Exit(0)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAddChildSecondShutdownExit$")
+	cmd.Env = append(os.Environ(), "SHUTDOWN_TEST_CHILD_EXIT=1")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("want exit code 0, got %v", err)
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time used by a manager for timeouts and the status timer.
+// The default clock uses the time package. See WithClock.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After returns a channel that receives the current time when d has elapsed.
+	After(d time.Duration) <-chan time.Time
+
+	// NewTimer returns a timer that fires when d has elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a timer returned by a Clock.
+type Timer interface {
+	// C returns the channel that receives the time when the timer fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing.
+	// It returns false if the timer has already fired or been stopped.
+	Stop() bool
+}
+
+// realClock is a Clock using the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTimer(d time.Duration) Timer         { return realTimer{t: time.NewTimer(d)} }
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (r realTimer) C() <-chan time.Time { return r.t.C }
+func (r realTimer) Stop() bool          { return r.t.Stop() }
+
+// Clock returns the clock used by the manager, see WithClock.
+// Packages managing resources can use it, so their polling and timeouts
+// follow a manual clock in tests.
+func (m *Manager) Clock() Clock {
+	return m.clock
+}
+
+// since returns the time elapsed since t according to the clock of the manager.
+func (m *Manager) since(t time.Time) time.Duration {
+	return m.clock.Now().Sub(t)
+}
+
+// timeoutContext returns a child of parent that is cancelled when d has elapsed
+// according to the clock of the manager. A zero d means no timeout.
+func (m *Manager) timeoutContext(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d == 0 {
+		return context.WithCancel(parent)
+	}
+	if _, ok := m.clock.(realClock); ok {
+		return context.WithTimeout(parent, d)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	t := m.clock.NewTimer(d)
+	go func() {
+		select {
+		case <-t.C():
+			cancel()
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}()
+	return ctx, cancel
+}
+
+// ManualClock is a Clock that only moves when Advance is called.
+// It can be used with WithClock to make tests of timeouts deterministic.
+type ManualClock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock returns a manual clock starting at now.
+func NewManualClock(now time.Time) *ManualClock {
+	c := &ManualClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns a channel that receives the time when the clock has been advanced by d.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+// NewTimer returns a timer that fires when the clock has been advanced by d.
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &manualTimer{c: c, ch: make(chan time.Time, 1), at: c.now.Add(d)}
+	if d <= 0 {
+		t.ch <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	c.cond.Broadcast()
+	return t
+}
+
+// Advance moves the clock forward by d and fires all timers that are due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		t.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// BlockUntil waits until at least n timers are waiting for the clock to advance.
+func (c *ManualClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.timers) < n {
+		c.cond.Wait()
+	}
+}
+
+type manualTimer struct {
+	c  *ManualClock
+	ch chan time.Time
+	at time.Time
+}
+
+func (t *manualTimer) C() <-chan time.Time { return t.ch }
+
+func (t *manualTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	for i, p := range t.c.timers {
+		if p == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewManualClock(start)
+	t1 := c.NewTimer(time.Second)
+	t2 := c.NewTimer(2 * time.Second)
+	after := c.After(3 * time.Second)
+	if !t2.Stop() {
+		t.Fatal("pending timer should be stopped")
+	}
+	c.Advance(time.Second)
+	select {
+	case got := <-t1.C():
+		if !got.Equal(start.Add(time.Second)) {
+			t.Errorf("want %v, got %v", start.Add(time.Second), got)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	if t1.Stop() {
+		t.Error("fired timer should not be stopped")
+	}
+	c.Advance(time.Second)
+	select {
+	case <-t2.C():
+		t.Fatal("stopped timer fired")
+	case <-after:
+		t.Fatal("After fired early")
+	default:
+	}
+	c.Advance(time.Second)
+	<-after
+	if got := c.Now(); !got.Equal(start.Add(3 * time.Second)) {
+		t.Errorf("want %v, got %v", start.Add(3*time.Second), got)
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	c := NewManualClock(time.Now())
+	var rec eventRecorder
+	timedOut := make(chan Stage, 1)
+	m := New(WithClock(c), WithLogger(rec.log), WithTimeout(time.Hour), WithOnTimeout(func(s Stage, ctx string) {
+		timedOut <- s
+	}))
+	f := m.First()
+	go func() {
+		<-f.Notify()
+	}()
+
+	go m.Shutdown()
+	for s, ok := m.CurrentStage(); !ok || s != Stage1; s, ok = m.CurrentStage() {
+		time.Sleep(time.Millisecond)
+	}
+	// The stage timeout and the status timer.
+	c.BlockUntil(2)
+	select {
+	case <-timedOut:
+		t.Fatal("stage timed out before the clock was advanced")
+	default:
+	}
+	c.Advance(time.Hour)
+	if s := <-timedOut; s != Stage1 {
+		t.Errorf("want timeout in stage 1, got %d", s.Index())
+	}
+	m.Wait()
+
+	for _, e := range rec.get() {
+		if e.Kind == EventStageTimeout && e.Duration != time.Hour {
+			t.Errorf("want stage duration of exactly 1h, got %v", e.Duration)
+		}
+	}
+}
+
+func TestOnTimeoutV2(t *testing.T) {
+	c := NewManualClock(time.Now())
+	elapsed := make(chan time.Duration, 1)
+	m := New(WithClock(c), WithLogger(nil), WithTimeout(time.Hour), WithOnTimeoutV2(func(s Stage, ctx string, d time.Duration) {
+		if s == Stage1 {
+			elapsed <- d
+		}
+	}))
+	f := m.First()
+	go func() {
+		<-f.Notify()
+	}()
+
+	go m.Shutdown()
+	for s, ok := m.CurrentStage(); !ok || s != Stage1; s, ok = m.CurrentStage() {
+		time.Sleep(time.Millisecond)
+	}
+	c.BlockUntil(2)
+	c.Advance(time.Hour)
+	if d := <-elapsed; d != time.Hour {
+		t.Errorf("want elapsed time of exactly 1h, got %v", d)
+	}
+	m.Wait()
+}
+
+func TestOnTimeoutV3(t *testing.T) {
+	const reason = "deploy"
+	c := NewManualClock(time.Now())
+	var rec eventRecorder
+	reasons := make(chan string, 1)
+	m := New(WithClock(c), WithLogger(nil), WithEventHook(rec.log), WithTimeout(time.Hour),
+		WithOnTimeoutV3(func(s Stage, ctx string, d time.Duration, r string) {
+			if s == Stage1 {
+				reasons <- r
+			}
+		}))
+	f := m.First()
+	go func() {
+		<-f.Notify()
+	}()
+
+	go m.ShutdownWith(reason)
+	for s, ok := m.CurrentStage(); !ok || s != Stage1; s, ok = m.CurrentStage() {
+		time.Sleep(time.Millisecond)
+	}
+	c.BlockUntil(2)
+	c.Advance(time.Hour)
+	if r := <-reasons; r != reason {
+		t.Errorf("want reason %q, got %q", reason, r)
+	}
+	m.Wait()
+	var timedOut bool
+	for _, e := range rec.get() {
+		if e.Kind == EventNotifierTimeout {
+			timedOut = true
+			if !strings.Contains(e.Message, "(reason: "+reason+")") {
+				t.Errorf("reason not in timeout message, got %q", e.Message)
+			}
+		}
+	}
+	if !timedOut {
+		t.Error("no notifier timeout logged")
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CloseOnShutdown will close all closers in stage s, in the order they are given.
+// An error from one closer is logged and does not prevent the rest from being closed.
+// The returned notifier can be used to cancel closing them.
+func (m *Manager) CloseOnShutdown(s Stage, closers ...io.Closer) Notifier {
+	return m.onFunc(s.n, 1, func(context.Context) {
+		for _, c := range closers {
+			if err := c.Close(); err != nil {
+				m.log(Event{Level: LevelWarn, Stage: s, Context: fmt.Sprintf("%T", c), Message: fmt.Sprintf("Error closing %T: %v", c, err)})
+			}
+		}
+	}, nil)
+}
+
+// WaitGroupFn will wait for wg in stage s, so the stage does not finish
+// until the goroutines tracked by wg have called Done.
+// The stage timeout still applies, and the stage advances if wg is not done in time.
+// The returned notifier can be used to cancel waiting.
+func (m *Manager) WaitGroupFn(wg *sync.WaitGroup, s Stage) Notifier {
+	return m.onFunc(s.n, 1, func(ctx context.Context) {
+		done := make(chan struct{})
+		go func() {
+			// Wait cannot be cancelled, so the goroutine exits when wg is done.
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}, []interface{}{"WaitGroup"})
+}
+
+// GuardWriter returns an io.Writer that locks shutdown while a Write to w is in progress,
+// like WrapHandler does for requests, so w is not closed in the middle of a write.
+// Writes are serialized, so the returned writer can be used by several goroutines
+// even if w cannot. Once shutdown has been initiated, Write returns ErrShuttingDown.
+func (m *Manager) GuardWriter(w io.Writer) io.Writer {
+	return &guardedWriter{m: m, w: w, ctx: []interface{}{"GuardWriter", fmt.Sprintf("%T", w)}}
+}
+
+type guardedWriter struct {
+	m   *Manager
+	ctx []interface{}
+	mu  sync.Mutex
+	w   io.Writer
+}
+
+func (g *guardedWriter) Write(p []byte) (int, error) {
+	unlock, err := g.m.lock(1, g.ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.w.Write(p)
+}
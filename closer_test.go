@@ -0,0 +1,144 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testCloser struct {
+	err    error
+	closed bool
+}
+
+func (c *testCloser) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestCloseOnShutdown(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	closers := []*testCloser{{}, {err: errors.New("close failed")}, {}}
+	m.CloseOnShutdown(Stage2, closers[0], closers[1], closers[2])
+	m.Shutdown()
+	for i, c := range closers {
+		if !c.closed {
+			t.Errorf("closer %d was not closed", i)
+		}
+	}
+	var found bool
+	for _, e := range rec.get() {
+		if e.Level == LevelWarn && strings.Contains(e.Message, "close failed") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("close error was not logged")
+	}
+}
+
+func TestCloseOnShutdownCancel(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	c := &testCloser{}
+	m.CloseOnShutdown(Stage1, c).Cancel()
+	m.Shutdown()
+	if c.closed {
+		t.Error("closer was closed after the notifier was cancelled")
+	}
+}
+
+// blockingWriter blocks each write until release is closed.
+type blockingWriter struct {
+	writing chan struct{}
+	release chan struct{}
+	n       int
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	w.writing <- struct{}{}
+	<-w.release
+	return len(p), nil
+}
+
+func TestGuardWriter(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	bw := &blockingWriter{writing: make(chan struct{}, 2), release: make(chan struct{})}
+	w := m.GuardWriter(bw)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := w.Write([]byte("data"))
+			errs <- err
+		}()
+	}
+	<-bw.writing
+	// Both writes must hold a lock before shutdown starts.
+	for m.LocksHeld() != 2 {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("shutdown finished during a write")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(bw.release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Error("unexpected error:", err)
+		}
+	}
+	<-done
+	if bw.n != 8 {
+		t.Errorf("want 8 bytes written, got %d", bw.n)
+	}
+	if _, err := w.Write([]byte("late")); !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("want %v after shutdown, got %v", ErrShuttingDown, err)
+	}
+}
+
+func TestWaitGroupFn(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage2, 20*time.Millisecond), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var finished atomic.Bool
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		finished.Store(true)
+		wg.Done()
+	}()
+	m.WaitGroupFn(&wg, Stage1)
+	var before bool
+	m.SecondFn(func() { before = finished.Load() })
+
+	// A wait group that is never done times out with the stage.
+	var stuck sync.WaitGroup
+	stuck.Add(1)
+	defer stuck.Done()
+	m.WaitGroupFn(&stuck, Stage2)
+	m.Shutdown()
+
+	if !before {
+		t.Error("stage 2 started before the wait group was done")
+	}
+	if got := m.Metrics().StageTimeouts; got != 1 {
+		t.Errorf("want stage 2 to time out, got %d timeouts", got)
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// ManageCmd terminates the started command cmd in stage s.
+// The stage sends sig to the process, and waits for it to exit, no longer than the timeout of the stage.
+// If the process has not exited when the stage times out, or sig cannot be sent, the process is killed.
+// The command name and PID are added to the context of the notifier.
+//
+// ManageCmd waits for the command, so cmd.Wait must not be called by the caller.
+// The result of cmd.Wait is sent on the returned channel instead.
+// If the process exits before shutdown, the notifier is cancelled.
+// If the stage has already started, sig is sent at once and an invalid notifier is returned.
+// If cmd has not been started, an invalid notifier and a nil channel are returned.
+func (m *Manager) ManageCmd(cmd *exec.Cmd, s Stage, sig os.Signal) (Notifier, <-chan error) {
+	if cmd.Process == nil {
+		return Notifier{}, nil
+	}
+	exited := make(chan error, 1)
+	done := make(chan struct{})
+	name := fmt.Sprintf("%s (pid %d)", filepath.Base(cmd.Path), cmd.Process.Pid)
+	n := m.onFunc(s.n, 1, func(ctx context.Context) {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if err := cmd.Process.Signal(sig); err != nil {
+			m.log(Event{Level: LevelWarn, Stage: s, Context: name, Message: fmt.Sprintf("Unable to signal command, killing it: %v", err)})
+			_ = cmd.Process.Kill()
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			m.log(Event{Level: LevelWarn, Stage: s, Context: name, Message: "Command did not exit, killing it"})
+			_ = cmd.Process.Kill()
+		}
+	}, []interface{}{name})
+	if !n.Valid() {
+		_ = cmd.Process.Signal(sig)
+	}
+	go func() {
+		exited <- cmd.Wait()
+		close(done)
+		n.Cancel()
+	}()
+	return n, exited
+}
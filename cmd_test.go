@@ -0,0 +1,97 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build !windows
+
+package shutdown
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestManageCmd(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	n, exited := m.ManageCmd(cmd, Stage2, syscall.SIGTERM)
+	if !n.Valid() {
+		t.Fatal("notifier should be valid")
+	}
+	m.Shutdown()
+	select {
+	case err := <-exited:
+		if err == nil {
+			t.Error("want the signal as exit error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("command did not exit")
+	}
+}
+
+func TestManageCmdKill(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeout(time.Second), WithTimeoutN(Stage1, 50*time.Millisecond))
+	defer close(startTimer(m, t))
+	// The signal disposition is inherited by sleep, so it ignores SIGTERM.
+	cmd := exec.Command("sh", "-c", `trap "" TERM; exec sleep 10`)
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	_, exited := m.ManageCmd(cmd, Stage1, syscall.SIGTERM)
+	// Give the shell time to ignore the signal.
+	time.Sleep(50 * time.Millisecond)
+	m.Shutdown()
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("command was not killed")
+	}
+	var found bool
+	for _, e := range rec.get() {
+		found = found || (e.Message == "Command did not exit, killing it" && strings.Contains(e.Context, "(pid "))
+	}
+	if !found {
+		t.Errorf("kill not logged with pid, got %+v", rec.get())
+	}
+}
+
+func TestManageCmdExited(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Skip(err)
+	}
+	n, exited := m.ManageCmd(cmd, Stage1, syscall.SIGTERM)
+	if err := <-exited; err != nil {
+		t.Fatal(err)
+	}
+	stage := func() int {
+		m.sqM.Lock()
+		defer m.sqM.Unlock()
+		return n.stage()
+	}
+	deadline := time.Now().Add(time.Second)
+	for stage() != -1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if stage() != -1 {
+		t.Error("notifier not cancelled when the command exited")
+	}
+	m.Shutdown()
+}
+
+func TestManageCmdNotStarted(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	n, exited := m.ManageCmd(exec.Command("true"), Stage1, syscall.SIGTERM)
+	if n.Valid() || exited != nil {
+		t.Error("command that is not started should not be managed")
+	}
+}
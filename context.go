@@ -29,10 +29,56 @@ func (m *Manager) cancelContext(parent context.Context, s Stage) (ctx context.Co
 		select {
 		case <-ctx.Done():
 			f.CancelWait()
-		case v := <-f.Notify():
+		case v, ok := <-f.Notify():
 			cancel()
-			close(v)
+			if ok {
+				close(v)
+			}
 		}
 	}()
 	return ctx, cancel
 }
+
+// CancelOnShutdown will call cancel at the supplied shutdown stage.
+// The returned notifier can be cancelled with Cancel or CancelWait
+// if the context is torn down before shutdown.
+// If the stage has already started, cancel is called at once and an invalid notifier is returned.
+func (m *Manager) CancelOnShutdown(cancel context.CancelFunc, s Stage) Notifier {
+	n := m.onFunc(s.n, 1, func(context.Context) { cancel() }, nil)
+	if !n.Valid() {
+		cancel()
+	}
+	return n
+}
+
+// watchTrigger starts shutdown when the context set with WithTriggerContext is done.
+// The goroutine exits when shutdown has finished.
+func (m *Manager) watchTrigger() {
+	ctx := m.triggerCtx
+	if ctx == nil {
+		return
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.ShutdownWith("context: " + contextCause(ctx).Error())
+		case <-m.shutdownFinished:
+		}
+	}()
+}
+
+// managerKey is the context key of the manager, see WithContext.
+type managerKey struct{}
+
+// WithContext returns a copy of ctx that carries m, so handlers further down
+// a middleware chain can get the manager with FromContext, for instance to call Lock.
+func (m *Manager) WithContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, managerKey{}, m)
+}
+
+// FromContext returns the manager stored in ctx with WithContext.
+// If ctx carries no manager, false is returned.
+func FromContext(ctx context.Context) (*Manager, bool) {
+	m, ok := ctx.Value(managerKey{}).(*Manager)
+	return m, ok && m != nil
+}
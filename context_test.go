@@ -5,6 +5,7 @@ package shutdown
 import (
 	"context"
 	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -143,3 +144,82 @@ func TestCancelCtxNShutdown(t *testing.T) {
 	// Ensure shutdown is not blocking
 	m.Shutdown()
 }
+
+func TestCancelOnShutdown(t *testing.T) {
+	m := New(WithTimeout(time.Millisecond * 1000))
+	defer close(startTimer(m, t))
+	ctx, cancel := context.WithCancel(context.Background())
+	m.CancelOnShutdown(cancel, Stage2)
+	var ctxErr error
+	m.FirstFn(func() { ctxErr = ctx.Err() })
+	m.Shutdown()
+	if ctxErr != nil {
+		t.Errorf("context cancelled before stage 2: %v", ctxErr)
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("ctx.Err() == %v want %v", ctx.Err(), context.Canceled)
+	}
+	// Registering after the stage has started cancels at once.
+	ctx, cancel = context.WithCancel(context.Background())
+	if m.CancelOnShutdown(cancel, Stage1).Valid() {
+		t.Error("expected invalid notifier")
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("ctx.Err() == %v want %v", ctx.Err(), context.Canceled)
+	}
+}
+
+func TestCancelOnShutdownCancel(t *testing.T) {
+	m := New(WithTimeout(time.Millisecond * 1000))
+	defer close(startTimer(m, t))
+	var called atomic.Bool
+	n := m.CancelOnShutdown(func() { called.Store(true) }, Stage1)
+	n.Cancel()
+	n = m.CancelOnShutdown(func() { called.Store(true) }, Stage2)
+	m.FirstFn(func() { n.CancelWait() })
+	m.Shutdown()
+	if called.Load() {
+		t.Error("cancel func was called after the notifier was cancelled")
+	}
+}
+
+func TestTriggerContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := New(WithTriggerContext(ctx), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	if m.Started() {
+		t.Fatal("shutdown started before the context was cancelled")
+	}
+	cancel()
+	if !m.WaitTimeout(time.Second) {
+		t.Fatal("shutdown did not finish after the context was cancelled")
+	}
+	if got, want := m.ShutdownReason(), "context: "+context.Canceled.Error(); got != want {
+		t.Errorf("want reason %q, got %q", want, got)
+	}
+}
+
+func TestManagerContext(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	if _, ok := FromContext(context.Background()); ok {
+		t.Fatal("manager found in empty context")
+	}
+	ctx, cancel := context.WithCancel(m.WithContext(context.Background()))
+	defer cancel()
+	got, ok := FromContext(ctx)
+	if !ok || got != m {
+		t.Fatalf("want the manager, got %p, %v", got, ok)
+	}
+
+	// The innermost manager wins.
+	scope := m.NewScope()
+	if got, _ := FromContext(scope.WithContext(ctx)); got != scope {
+		t.Errorf("want the scope, got %p", got)
+	}
+	unlock := got.Lock()
+	if unlock == nil {
+		t.Fatal("lock from context manager failed")
+	}
+	unlock()
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// writeStuckDump writes the notifiers that did not finish in a stage
+// followed by the goroutine profile to the stuck dump writer.
+func (m *Manager) writeStuckDump(s Stage, stuck []string) {
+	w := m.stuckDump
+	fmt.Fprintf(w, "Stage %d timed out waiting for %d notifier(s):\n", s.n, len(stuck))
+	for _, ctx := range stuck {
+		if ctx == "" {
+			ctx = "(unknown, lock timeout logging disabled)"
+		}
+		fmt.Fprintf(w, "\t%s\n", ctx)
+	}
+	fmt.Fprintln(w)
+	if err := pprof.Lookup("goroutine").WriteTo(w, 1); err != nil {
+		m.log(Event{Level: LevelError, Stage: s, Message: fmt.Sprintf("Unable to write goroutine dump: %v", err)})
+	}
+}
+
+// escalate is called by the status timer each time it has reported that notifier n is running.
+// ticks is the number of times it has been reported.
+func (m *Manager) escalate(stage int, start time.Time, n iNotifier, ticks int) {
+	e := m.statusEscalation
+	if e <= 0 {
+		return
+	}
+	switch ticks {
+	case e:
+		var buf bytes.Buffer
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+			m.log(Event{Level: LevelError, Stage: Stage{stage}, Message: fmt.Sprintf("Unable to write goroutine dump: %v", err)})
+			return
+		}
+		m.logStatus(Event{Level: LevelWarn, Stage: Stage{stage}, Context: n.calledFrom, labels: n.labels, Message: "Notifier still running, goroutines:\n" + buf.String(), Duration: m.since(start)})
+	case 2 * e:
+		if m.onTimeOut != nil {
+			m.onTimeOut(Stage{stage}, n.calledFrom, m.since(start), m.ShutdownReason())
+		}
+	}
+}
+
+// DumpPlan writes the notifiers that are currently registered to w, grouped by stage
+// in the order they will be notified, with their context and registration site.
+// It shows what will happen when shutdown runs, and does not change the manager.
+// Registration sites are only recorded if lock timeout logging or lock tracking is enabled.
+func (m *Manager) DumpPlan(w io.Writer) error {
+	type stagePlan struct {
+		timeout time.Duration
+		mode    StageMode
+		queue   []iNotifier
+		groups  [][]int
+	}
+	var plan [4]stagePlan
+	m.sqM.Lock()
+	m.srM.RLock()
+	for i := range plan {
+		queue := append([]iNotifier(nil), m.shutdownQueue[i]...)
+		plan[i] = stagePlan{
+			timeout: m.timeouts[i],
+			mode:    m.stageModes[i],
+			queue:   queue,
+			groups:  m.stageGroups(i, queue),
+		}
+	}
+	m.srM.RUnlock()
+	m.sqM.Unlock()
+
+	for i, p := range plan {
+		mode := "parallel"
+		if p.mode == SequentialMode {
+			mode = "sequential"
+		}
+		if _, err := fmt.Fprintf(w, "Stage %d, timeout %v, %s, %d notifier(s):\n", i, p.timeout, mode, len(p.queue)); err != nil {
+			return err
+		}
+		for g, group := range p.groups {
+			for _, j := range group {
+				ctx := p.queue[j].calledFrom
+				if ctx == "" {
+					ctx = p.queue[j].n.site
+				}
+				if ctx == "" {
+					ctx = "(unknown, lock timeout logging and lock tracking disabled)"
+				}
+				if _, err := fmt.Fprintf(w, "\t%d. [priority %d] %s\n", g+1, p.queue[j].priority, ctx); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// OnSignalDump writes the status of the manager to w each time one of the signals arrives,
+// without starting shutdown. The status contains the current stage, the locks that are held,
+// the progress reported by notifiers in the running stage, and the plan written by DumpPlan.
+// A common choice is syscall.SIGUSR1. The returned function removes the handler.
+func (m *Manager) OnSignalDump(w io.Writer, sig ...os.Signal) (cancel func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sig...)
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				if err := m.writeStatus(w); err != nil {
+					m.log(Event{Level: LevelError, Message: fmt.Sprintf("Unable to write status: %v", err)})
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(stop)
+		})
+	}
+}
+
+// writeStatus writes the status of the manager to w, see OnSignalDump.
+func (m *Manager) writeStatus(w io.Writer) error {
+	stage, running := m.CurrentStage()
+	status := "not started"
+	switch {
+	case running:
+		status = fmt.Sprintf("running stage %d", stage.n)
+		if reason := m.ShutdownReason(); reason != "" {
+			status += ", reason: " + reason
+		}
+	case m.Started():
+		status = "completed"
+	}
+	if _, err := fmt.Fprintf(w, "Shutdown %s, %d lock(s) held:\n", status, m.LocksHeld()); err != nil {
+		return err
+	}
+	for _, l := range m.heldLocks() {
+		if _, err := fmt.Fprintf(w, "\t%s, held for %v\n", l.calledFrom, m.since(l.start)); err != nil {
+			return err
+		}
+	}
+	if running {
+		m.sqM.Lock()
+		var lines []string
+		for _, n := range m.shutdownQueue[stage.n] {
+			if p, ok := m.progress[n.n.c]; ok {
+				lines = append(lines, fmt.Sprintf("\t%s: %s\n", n.calledFrom, p.message(stage.n)))
+			}
+		}
+		m.sqM.Unlock()
+		for _, l := range lines {
+			if _, err := io.WriteString(w, l); err != nil {
+				return err
+			}
+		}
+	}
+	return m.DumpPlan(w)
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStuckDump(t *testing.T) {
+	var buf bytes.Buffer
+	m := New(WithStuckDump(&buf), WithTimeout(time.Second), WithTimeoutN(Stage1, time.Millisecond*20))
+	defer close(startTimer(m, t))
+
+	const testctx = "stuck context"
+	_ = m.FirstFn(func() {})
+	f := m.First(testctx)
+	go func() {
+		<-f.Notify()
+	}()
+	m.Shutdown()
+
+	got := buf.String()
+	if !strings.Contains(got, "Stage 1 timed out waiting for 1 notifier(s)") {
+		t.Errorf("dump should contain the stage header, got %q", got)
+	}
+	if !strings.Contains(got, testctx) {
+		t.Errorf("dump should contain %q", testctx)
+	}
+	if !strings.Contains(got, "goroutine profile") {
+		t.Errorf("dump should contain the goroutine profile")
+	}
+}
+
+func TestDumpPlan(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithStageMode(Stage2, SequentialMode))
+	defer close(startTimer(m, t))
+	_ = m.FirstFn(func() {}, "close database", WithPriority(1))
+	_ = m.First("stop workers")
+	_ = m.Second("flush logs")
+	_ = m.SecondFn(func() {}, "remove pid file")
+
+	var buf bytes.Buffer
+	if err := m.DumpPlan(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		"Stage 0, timeout 1s, parallel, 0 notifier(s)",
+		"Stage 1, timeout 1s, parallel, 2 notifier(s)",
+		"Stage 2, timeout 1s, sequential, 2 notifier(s)",
+		"1. [priority 0] [stop workers] - ",
+		"2. [priority 1] [close database] - ",
+		"2. [priority 0] [remove pid file] - ",
+		"dump_test.go:",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("plan should contain %q, got:\n%s", want, got)
+		}
+	}
+	if strings.Index(got, "stop workers") > strings.Index(got, "close database") {
+		t.Errorf("notifiers should be listed in notification order, got:\n%s", got)
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	var buf bytes.Buffer
+	var err error
+	var n Notifier
+	n = m.FirstFn(func() {
+		n.Progress(0.5, "flush")
+		err = m.writeStatus(&buf)
+	}, "flusher")
+	m.ShutdownWith("deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{"Shutdown running stage 1, reason: deploy, 0 lock(s) held", "[flusher] - ", "Stage 1, flush 50% complete"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("status should contain %q, got:\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build !windows
+
+package shutdown
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOnSignalDump(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	_ = m.FirstFn(func() {}, "close database")
+	unlock := m.Lock("serving request")
+	defer unlock()
+
+	var mu sync.Mutex
+	var buf bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return buf.Write(p)
+	})
+	cancel := m.OnSignalDump(w, syscall.SIGUSR1)
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(got, "Stage 3") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		got = buf.String()
+		mu.Unlock()
+	}
+	for _, want := range []string{"Shutdown not started, 1 lock(s) held", "[serving request]", "[close database]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("status should contain %q, got:\n%s", want, got)
+		}
+	}
+	if m.Started() {
+		t.Fatal("signal started shutdown")
+	}
+	cancel()
+	cancel()
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
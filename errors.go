@@ -0,0 +1,135 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrShuttingDown is returned by TryLock when shutdown has been initiated.
+var ErrShuttingDown = errors.New("shutdown: shutting down")
+
+// ErrCycle is returned by AddChild when the child would be its own ancestor.
+var ErrCycle = errors.New("shutdown: child manager would create a cycle")
+
+// PanicPolicy controls what happens when a panic is recovered in a shutdown function.
+// See WithPanicPolicy.
+type PanicPolicy int
+
+const (
+	// PanicRecover recovers the panic and continues the shutdown. This is the default.
+	PanicRecover PanicPolicy = iota
+
+	// PanicRepanic recovers the panic, and panics with the *PanicError from Shutdown
+	// when the stage that was running has finished. The following stages are not run,
+	// but shutdown is completed first, so Wait, WaitStage and other calls to Shutdown
+	// return, and the completion callbacks are called, before the panic is raised.
+	PanicRepanic
+
+	// PanicExit calls os.Exit(2) when the panic has been reported, if os.Exit is enabled.
+	// See WithOSExit.
+	PanicExit
+)
+
+// PanicError is a panic that was recovered in a shutdown function.
+type PanicError struct {
+	// Stage is the stage of the function.
+	Stage Stage
+
+	// Context is the context of the function.
+	Context string
+
+	// Recovered is the value returned by recover.
+	Recovered interface{}
+
+	// Stack is the stack trace of the panic.
+	Stack []byte
+}
+
+// Error returns the recovered value and context.
+func (e *PanicError) Error() string {
+	if e.Context == "" {
+		return fmt.Sprintf("shutdown: panic in stage %d: %v", e.Stage.n, e.Recovered)
+	}
+	return fmt.Sprintf("shutdown: panic in stage %d: %v (%s)", e.Stage.n, e.Recovered, e.Context)
+}
+
+// Errors contains the errors that occurred during a shutdown, in the order they occurred.
+type Errors []error
+
+// Error returns all errors, one per line.
+func (e Errors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+// Unwrap returns the errors, so they can be inspected with errors.Is and errors.As.
+func (e Errors) Unwrap() []error {
+	return e
+}
+
+// Err returns the errors that have occurred during shutdown as Errors.
+// If no errors have occurred nil is returned.
+func (m *Manager) Err() error {
+	m.errM.Lock()
+	defer m.errM.Unlock()
+	if len(m.errs) == 0 {
+		return nil
+	}
+	return append(Errors(nil), m.errs...)
+}
+
+// addErr adds an error to the shutdown errors.
+func (m *Manager) addErr(err error) {
+	m.errM.Lock()
+	m.errs = append(m.errs, err)
+	m.errM.Unlock()
+}
+
+// recovered handles a panic recovered in a shutdown function.
+func (m *Manager) recovered(s Stage, ctx string, labels *map[string]string, r interface{}, stack []byte) {
+	m.log(Event{Kind: EventPanic, Level: LevelError, Stage: s, Context: ctx, labels: labels, Message: fmt.Sprintf("Panic in shutdown function: %v", r)})
+	m.log(Event{Level: LevelError, Stage: s, Message: string(stack)})
+	err := &PanicError{Stage: s, Context: ctx, Recovered: r, Stack: stack}
+	m.addErr(err)
+	if m.onPanic != nil {
+		m.onPanic(s, ctx, r, stack)
+	}
+	switch m.panicPolicy {
+	case PanicRepanic:
+		m.errM.Lock()
+		if m.repanic == nil {
+			m.repanic = err
+		}
+		m.errM.Unlock()
+	case PanicExit:
+		if m.performOSExit {
+			os.Exit(2)
+		}
+	}
+}
+
+// repanicPending returns true if a panic is waiting to be raised by checkRepanic.
+func (m *Manager) repanicPending() bool {
+	m.errM.Lock()
+	defer m.errM.Unlock()
+	return m.repanic != nil
+}
+
+// checkRepanic panics with the first panic recovered since the last call,
+// if the panic policy is PanicRepanic.
+func (m *Manager) checkRepanic() {
+	m.errM.Lock()
+	err := m.repanic
+	m.repanic = nil
+	m.errM.Unlock()
+	if err != nil {
+		panic(err)
+	}
+}
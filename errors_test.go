@@ -0,0 +1,153 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPanicReport(t *testing.T) {
+	type report struct {
+		s     Stage
+		ctx   string
+		r     interface{}
+		stack []byte
+	}
+	var mu sync.Mutex
+	var reports []report
+	m := New(WithOnPanic(func(s Stage, ctx string, r interface{}, stack []byte) {
+		mu.Lock()
+		reports = append(reports, report{s: s, ctx: ctx, r: r, stack: stack})
+		mu.Unlock()
+	}), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	if err := m.Err(); err != nil {
+		t.Fatal("unexpected error before shutdown:", err)
+	}
+	_ = m.FirstFn(func() { panic("first a") }, "ctx a")
+	_ = m.FirstFn(func() { panic("first b") }, "ctx b")
+	_ = m.SecondFn(func() { panic("second") }, "ctx c")
+	m.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reports) != 3 {
+		t.Fatalf("want 3 panics reported, got %d", len(reports))
+	}
+	for i, r := range reports {
+		if len(r.stack) == 0 {
+			t.Errorf("panic %d: missing stack", i)
+		}
+	}
+	if reports[2].s != Stage2 || reports[2].r != "second" || !strings.Contains(reports[2].ctx, "ctx c") {
+		t.Errorf("want last panic from stage 2, got %+v", reports[2])
+	}
+
+	errs, ok := m.Err().(Errors)
+	if !ok || len(errs) != 3 {
+		t.Fatalf("want 3 errors, got %#v", m.Err())
+	}
+	// The stage 1 functions run in parallel, so their panics can be recorded in any order,
+	// but the errors must match the reports, and stage 2 must be last.
+	want := map[interface{}]bool{}
+	for _, r := range reports {
+		want[r.r] = true
+	}
+	for i, err := range errs {
+		pe, ok := err.(*PanicError)
+		if !ok {
+			t.Fatalf("error %d: want *PanicError, got %T", i, err)
+		}
+		if !want[pe.Recovered] {
+			t.Errorf("error %d: unexpected or repeated %v", i, pe.Recovered)
+		}
+		delete(want, pe.Recovered)
+	}
+	if pe, _ := errs[2].(*PanicError); pe.Recovered != "second" {
+		t.Errorf("want last error from stage 2, got %v", pe.Recovered)
+	}
+	if !strings.Contains(m.Err().Error(), "first a") {
+		t.Errorf("error should contain the recovered value, got %q", m.Err().Error())
+	}
+}
+
+func TestPanicRepanic(t *testing.T) {
+	reported := make(chan interface{}, 1)
+	m := New(WithPanicPolicy(PanicRepanic), WithTimeout(time.Second), WithLogger(nil),
+		WithOnPanic(func(s Stage, ctx string, r interface{}, stack []byte) { reported <- r }))
+	defer close(startTimer(m, t))
+	_ = m.FirstFn(func() { panic("first") })
+	var second bool
+	_ = m.SecondFn(func() { second = true })
+
+	func() {
+		defer func() {
+			r := recover()
+			pe, ok := r.(*PanicError)
+			if !ok {
+				t.Fatalf("want *PanicError from Shutdown, got %#v", r)
+			}
+			if pe.Stage != Stage1 || pe.Recovered != "first" {
+				t.Errorf("unexpected panic: %v", pe)
+			}
+		}()
+		m.Shutdown()
+	}()
+	if second {
+		t.Error("stage 2 should not run after the repanic")
+	}
+	select {
+	case r := <-reported:
+		if r != "first" {
+			t.Errorf("want panic reported, got %v", r)
+		}
+	default:
+		t.Error("panic was not reported")
+	}
+}
+
+func TestPanicRepanicWait(t *testing.T) {
+	m := New(WithPanicPolicy(PanicRepanic), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	_ = m.FirstFn(func() { panic("first") })
+	_ = m.ThirdFn(func() {})
+	transitions := m.Transitions()
+
+	func() {
+		defer func() {
+			if _, ok := recover().(*PanicError); !ok {
+				t.Fatal("want *PanicError from Shutdown")
+			}
+		}()
+		m.Shutdown()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		m.Wait()
+		m.WaitStage(Stage3)
+		for range transitions {
+		}
+		m.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waiters blocked after the repanic")
+	}
+}
+
+func TestPanicExitDisabled(t *testing.T) {
+	m := New(WithPanicPolicy(PanicExit), WithOSExit(false), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	_ = m.FirstFn(func() { panic("first") })
+	m.Shutdown()
+	if m.Err() == nil {
+		t.Error("panic should be recorded")
+	}
+}
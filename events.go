@@ -0,0 +1,290 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of an Event.
+type Level int
+
+const (
+	// LevelInfo is used for events that describe normal progress.
+	LevelInfo Level = iota
+	// LevelWarn is used for events that may indicate a problem, like a slow notifier.
+	LevelWarn
+	// LevelError is used for timeouts and panics.
+	LevelError
+)
+
+// String returns the name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// EventKind identifies what an Event describes.
+type EventKind int
+
+const (
+	// EventMessage is a message that is not covered by the other kinds.
+	EventMessage EventKind = iota
+	// EventShutdownStarted is sent when the shutdown sequence starts.
+	EventShutdownStarted
+	// EventStageStarted is sent when a stage starts notifying.
+	EventStageStarted
+	// EventStageCompleted is sent when a stage has finished.
+	// Duration is the time the stage took.
+	EventStageCompleted
+	// EventNotifierWaiting is sent by the status timer while a notifier is running.
+	EventNotifierWaiting
+	// EventNotifierTimeout is sent when a notifier did not finish before the stage timed out.
+	EventNotifierTimeout
+	// EventStageTimeout is sent when a stage times out.
+	EventStageTimeout
+	// EventLockExpired is sent when a lock was held longer than the pre shutdown timeout.
+	EventLockExpired
+	// EventPanic is sent when a panic in a shutdown function has been recovered.
+	EventPanic
+	// EventNotifierUnserviced is sent when a stage times out and the notification
+	// of a notifier was never received from its Notify channel.
+	// Context is the context and registration site of the notifier.
+	EventNotifierUnserviced
+	// EventShutdownCompleted is sent when shutdown has completed, if enabled with WithSummary.
+	// Duration is the total time of the shutdown, and Context is the reason of the shutdown.
+	EventShutdownCompleted
+)
+
+// Event contains information about something that happened in the manager.
+// Events are delivered to the function set with WithLogger.
+type Event struct {
+	// Kind identifies what the event describes.
+	Kind EventKind
+
+	// Level is the severity of the event.
+	Level Level
+
+	// Stage is the stage the event relates to.
+	Stage Stage
+
+	// Context is the context of the notifier or lock the event relates to, if any.
+	// For EventShutdownStarted it is the reason of the shutdown.
+	Context string
+
+	// Reason is the reason given for the shutdown, see ShutdownWith.
+	Reason string
+
+	// Message is a human readable description of the event.
+	Message string
+
+	// Duration is the elapsed time of the stage or lock, if relevant for the event.
+	Duration time.Duration
+
+	// Progress is the fraction of the work done, as reported by the notifier with Notifier.Progress.
+	// It is only set on EventNotifierWaiting events.
+	Progress float64
+
+	// labels of the notifier, a pointer so events stay comparable.
+	labels *map[string]string
+}
+
+// Labels returns the labels of the notifier the event relates to, see WithLabels.
+// If the notifier has no labels, nil is returned. The map must not be modified.
+func (e Event) Labels() map[string]string {
+	if e.labels == nil {
+		return nil
+	}
+	return *e.labels
+}
+
+// String returns the message and context of the event.
+func (e Event) String() string {
+	if e.Context == "" {
+		return e.Message
+	}
+	return e.Message + ": " + e.Context
+}
+
+// formatLabels formats labels as "{key=value,...}", sorted by key.
+func formatLabels(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// printer returns a logger that formats events and writes them to p.
+// Warnings and errors are prefixed with the configured prefixes.
+func (m *Manager) printer(p LogPrinter) func(Event) {
+	return func(e Event) {
+		p.Printf("%s%s", m.prefix(e.Level), e.String())
+	}
+}
+
+// printerV2 is like printer, but also gives the stage and elapsed time of the event to fn.
+func (m *Manager) printerV2(fn func(s Stage, elapsed time.Duration, format string, v ...interface{})) func(Event) {
+	return func(e Event) {
+		fn(e.Stage, e.Duration, "%s%s", m.prefix(e.Level), e.String())
+	}
+}
+
+// prefix returns the configured prefix for the level.
+func (m *Manager) prefix(l Level) string {
+	switch l {
+	case LevelWarn:
+		return m.warningPrefix
+	case LevelError:
+		return m.errorPrefix
+	}
+	return ""
+}
+
+// withReason adds the shutdown reason to a timeout message, if a reason was given.
+func (m *Manager) withReason(msg string) string {
+	if r := m.ShutdownReason(); r != "" {
+		return msg + " (reason: " + r + ")"
+	}
+	return msg
+}
+
+// log sends an event to the logger and all hooks.
+func (m *Manager) log(e Event) {
+	m.logM.RLock()
+	logger := m.logger
+	m.logM.RUnlock()
+	m.deliver(e, logger)
+}
+
+// logStatus sends an event from the status timer to the status writer and all hooks.
+// If no status writer is set, it is the same as log.
+func (m *Manager) logStatus(e Event) {
+	if m.statusWriter == nil {
+		m.log(e)
+		return
+	}
+	m.deliver(e, func(e Event) {
+		fmt.Fprintf(m.statusWriter, "%s%s\n", m.prefix(e.Level), e.String())
+	})
+}
+
+// deliver sends an event to logger and all hooks.
+func (m *Manager) deliver(e Event, logger func(Event)) {
+	if e.Reason == "" {
+		e.Reason = m.ShutdownReason()
+	}
+	logger(e)
+	if m.testEvents != nil {
+		m.testEvents.add(e)
+	}
+	m.observe(e)
+	if m.recent != nil {
+		m.recent.add(e)
+	}
+	for _, hook := range m.hooks {
+		hook(e)
+	}
+}
+
+// SetLogPrinter replaces the log printer, like WithLogPrinter.
+// It can be called at any time, also while shutdown is running,
+// in which case the following events are written to fn.
+func (m *Manager) SetLogPrinter(fn func(format string, v ...interface{})) {
+	m.setLogger(WithLogPrinter(fn))
+}
+
+// SetLogPrinterV2 replaces the log printer, like WithLogPrinterV2.
+// It can be called at any time, see SetLogPrinter.
+func (m *Manager) SetLogPrinterV2(fn func(s Stage, elapsed time.Duration, format string, v ...interface{})) {
+	m.setLogger(WithLogPrinterV2(fn))
+}
+
+// SetLogger replaces the logger, like WithLogger.
+// It can be called at any time, see SetLogPrinter.
+func (m *Manager) SetLogger(fn func(e Event)) {
+	m.setLogger(WithLogger(fn))
+}
+
+// loggerOption returns an option that sets the logger built by fn.
+// fn is kept, so NewScope can build the logger again for the scope.
+func loggerOption(fn func(m *Manager) func(Event)) Option {
+	return func(m *Manager) {
+		m.newLogger = fn
+		m.logger = fn(m)
+	}
+}
+
+// setLogger applies an option that replaces the logger.
+func (m *Manager) setLogger(o Option) {
+	m.logM.Lock()
+	o(m)
+	m.logM.Unlock()
+}
+
+// eventRing keeps the most recent events, see WithEventBuffer.
+type eventRing struct {
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+}
+
+func newEventRing(n int) *eventRing {
+	return &eventRing{events: make([]Event, n)}
+}
+
+func (r *eventRing) add(e Event) {
+	r.mu.Lock()
+	r.events[r.next] = e
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// get returns the events, oldest first.
+func (r *eventRing) get() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]Event(nil), r.events[:r.next]...)
+	}
+	return append(append([]Event(nil), r.events[r.next:]...), r.events[:r.next]...)
+}
+
+// RecentEvents returns the most recent events, oldest first,
+// for instance to dump them from an admin endpoint or a panic handler.
+// The events are only kept if enabled with WithEventBuffer, otherwise nil is returned.
+// It is safe to call at any time.
+func (m *Manager) RecentEvents() []Event {
+	if m.recent == nil {
+		return nil
+	}
+	return m.recent.get()
+}
@@ -0,0 +1,408 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventRecorder collects events sent to the logger.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (r *eventRecorder) log(e Event) {
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+func (r *eventRecorder) get() []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+func TestLogger(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeout(time.Millisecond*50))
+	defer close(startTimer(m, t))
+
+	const testctx = "event context"
+	f := m.Second(testctx)
+	go func() {
+		<-f.Notify()
+	}()
+	m.Shutdown()
+
+	var found bool
+	for _, e := range rec.get() {
+		if e.Level != LevelError || !strings.Contains(e.Context, testctx) {
+			continue
+		}
+		found = true
+		if e.Stage != Stage2 {
+			t.Errorf("want stage 2, got %+v", e.Stage)
+		}
+		if e.Duration < time.Millisecond*50 {
+			t.Errorf("want duration >= 50ms, got %v", e.Duration)
+		}
+		if !strings.Contains(e.String(), e.Message) {
+			t.Errorf("String() %q should contain message %q", e.String(), e.Message)
+		}
+	}
+	if !found {
+		t.Fatalf("no timeout event with context %q, got %+v", testctx, rec.get())
+	}
+}
+
+func TestSummary(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithSummary(true), WithTimeout(time.Second), WithTimeoutN(Stage1, 20*time.Millisecond))
+	defer close(startTimer(m, t))
+
+	stuck := m.First("stuck")
+	go func() { <-stuck.Notify() }()
+	m.SecondFn(func() {})
+	m.ShutdownWith("deploy")
+
+	events := rec.get()
+	e := events[len(events)-1]
+	if e.Kind != EventShutdownCompleted {
+		t.Fatalf("want summary as the last event, got %+v", e)
+	}
+	for _, want := range []string{"Shutdown complete: 3 stages", "1 notifiers timed out", "reason: deploy"} {
+		if !strings.Contains(e.Message, want) {
+			t.Errorf("want %q in summary, got %q", want, e.Message)
+		}
+	}
+}
+
+func TestLogPrinterPrefix(t *testing.T) {
+	var buf = &logBuffer{fn: t.Logf}
+	m := New(WithLogPrinter(buf.WriteF), WithWarningPrefix("W! "), WithTimeout(10*time.Millisecond))
+	m.log(Event{Level: LevelWarn, Context: "ctx", Message: "msg"})
+	m.log(Event{Level: LevelInfo, Message: "info"})
+	if got, want := buf.buf.String(), "W! msg: ctx\ninfo\n"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSetLogPrinter(t *testing.T) {
+	m := New(WithLogger(nil), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var buf = &logBuffer{fn: t.Logf}
+	m.SetLogPrinter(buf.WriteF)
+	var rec eventRecorder
+	m.FirstFn(func() {
+		// Replacing the logger while shutdown is running must be race free.
+		m.SetLogger(rec.log)
+	})
+	m.Shutdown()
+
+	buf.Lock()
+	defer buf.Unlock()
+	if !strings.Contains(buf.buf.String(), "Initiating shutdown") {
+		t.Errorf("log printer set after New was not used, got %q", buf.buf.String())
+	}
+	if len(rec.get()) == 0 {
+		t.Error("events after the logger was replaced were not logged")
+	}
+}
+
+func TestLogPrinterV2(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	var stages []Stage
+	var elapsed time.Duration
+	m := New(WithLogPrinterV2(func(s Stage, d time.Duration, format string, v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		lines = append(lines, fmt.Sprintf(format, v...))
+		stages = append(stages, s)
+		if s == Stage1 && d > elapsed {
+			elapsed = d
+		}
+	}), WithTimeout(50*time.Millisecond))
+	defer close(startTimer(m, t))
+
+	f := m.First("slow")
+	go func() {
+		<-f.Notify()
+	}()
+	m.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var found bool
+	for i, l := range lines {
+		if strings.HasPrefix(l, "ERROR: ") && strings.Contains(l, "slow") {
+			found = true
+			if stages[i] != Stage1 {
+				t.Errorf("want stage 1, got %d", stages[i].Index())
+			}
+		}
+	}
+	if !found {
+		t.Errorf("no error line for the notifier, got %q", lines)
+	}
+	if elapsed < 50*time.Millisecond {
+		t.Errorf("want elapsed >= 50ms, got %v", elapsed)
+	}
+}
+
+func TestEventHook(t *testing.T) {
+	var rec, hooked eventRecorder
+	m := New(WithLogger(rec.log), WithEventHook(hooked.log), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	_ = m.FirstFn(func() {})
+	m.Shutdown()
+
+	if len(rec.get()) != len(hooked.get()) {
+		t.Fatalf("logger got %d events, hook got %d", len(rec.get()), len(hooked.get()))
+	}
+	kinds := map[EventKind]int{}
+	for _, e := range hooked.get() {
+		kinds[e.Kind]++
+	}
+	if kinds[EventShutdownStarted] != 1 {
+		t.Errorf("want 1 shutdown started event, got %d", kinds[EventShutdownStarted])
+	}
+	// The pre shutdown stage always waits for locks, so it is never empty.
+	if kinds[EventStageCompleted] != 2 {
+		t.Errorf("want 2 stage completed events, got %d", kinds[EventStageCompleted])
+	}
+}
+
+func TestEventBuffer(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithEventBuffer(3), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	if got := New().RecentEvents(); got != nil {
+		t.Fatalf("want no events without a buffer, got %v", got)
+	}
+	if got := m.RecentEvents(); len(got) != 0 {
+		t.Fatalf("want no events before shutdown, got %v", got)
+	}
+	_ = m.FirstFn(func() {
+		// Reading the buffer while events are added is safe.
+		for i := 0; i < 10; i++ {
+			_ = m.RecentEvents()
+		}
+	})
+	m.Shutdown()
+
+	all := rec.get()
+	got := m.RecentEvents()
+	if len(all) <= 3 || len(got) != 3 {
+		t.Fatalf("want the last 3 of %d events, got %d", len(all), len(got))
+	}
+	for i, e := range got {
+		if want := all[len(all)-3+i]; e != want {
+			t.Errorf("event %d: want %+v, got %+v", i, want, e)
+		}
+	}
+}
+
+func TestProgress(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithStatusTimer(10*time.Millisecond), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	f := m.Second("wal")
+	go func() {
+		v := <-f.Notify()
+		f.Progress(0.6, "flush")
+		time.Sleep(100 * time.Millisecond)
+		close(v)
+	}()
+	m.Shutdown()
+
+	var found bool
+	for _, e := range rec.get() {
+		if e.Kind != EventNotifierWaiting || e.Progress == 0 {
+			continue
+		}
+		found = true
+		if e.Progress != 0.6 {
+			t.Errorf("want progress 0.6, got %v", e.Progress)
+		}
+		if !strings.Contains(e.Message, "flush 60% complete") {
+			t.Errorf("message should contain progress, got %q", e.Message)
+		}
+	}
+	if !found {
+		t.Fatalf("no waiting event with progress, got %+v", rec.get())
+	}
+}
+
+func TestStatusEscalation(t *testing.T) {
+	var rec eventRecorder
+	var mu sync.Mutex
+	var alerts []string
+	m := New(WithLogger(rec.log), WithStatusTimer(10*time.Millisecond, WithEscalation(3)), WithTimeout(time.Second),
+		WithOnTimeout(func(s Stage, ctx string) {
+			mu.Lock()
+			alerts = append(alerts, ctx)
+			mu.Unlock()
+		}))
+	defer close(startTimer(m, t))
+
+	f := m.First("escalate")
+	go func() {
+		v := <-f.Notify()
+		time.Sleep(150 * time.Millisecond)
+		close(v)
+	}()
+	m.Shutdown()
+
+	var dumps int
+	for _, e := range rec.get() {
+		if strings.Contains(e.Message, "goroutine") && strings.Contains(e.Context, "escalate") {
+			dumps++
+		}
+	}
+	if dumps != 1 {
+		t.Errorf("want 1 goroutine dump, got %d", dumps)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(alerts) != 1 || !strings.Contains(alerts[0], "escalate") {
+		t.Errorf("want 1 alert for the notifier, got %q", alerts)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	var rec eventRecorder
+	var timedOut []string
+	m := New(WithLogger(rec.log), WithTimeout(time.Second), WithTimeoutN(Stage2, 20*time.Millisecond),
+		WithOnTimeout(func(s Stage, ctx string) { timedOut = append(timedOut, ctx) }))
+	defer close(startTimer(m, t))
+
+	m.Second("wal", WithLabels(map[string]string{"tenant": "a"}), WithLabels(map[string]string{"shard": "3"}))
+	m.Shutdown()
+
+	var found bool
+	for _, e := range rec.get() {
+		if e.Kind != EventNotifierTimeout {
+			continue
+		}
+		found = true
+		if got := e.Labels(); got["tenant"] != "a" || got["shard"] != "3" {
+			t.Errorf("want labels on the event, got %v", got)
+		}
+		if !strings.Contains(e.Context, "{shard=3,tenant=a} - [wal]") {
+			t.Errorf("want labels in the context, got %q", e.Context)
+		}
+	}
+	if !found {
+		t.Fatal("no timeout event")
+	}
+	if len(timedOut) != 1 || !strings.Contains(timedOut[0], "{shard=3,tenant=a}") {
+		t.Errorf("want labels in the timeout callback, got %q", timedOut)
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	var rec, hook eventRecorder
+	var w strings.Builder
+	m := New(WithLogger(rec.log), WithEventHook(hook.log), WithStatusTimer(10*time.Millisecond),
+		WithStatusWriter(&w), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	f := m.Second("wal")
+	go func() {
+		v := <-f.Notify()
+		time.Sleep(50 * time.Millisecond)
+		close(v)
+	}()
+	m.Shutdown()
+
+	if !strings.Contains(w.String(), "Stage 2, waiting for notifier: [wal]") {
+		t.Errorf("status not written, got %q", w.String())
+	}
+	var logged, hooked bool
+	for _, e := range rec.get() {
+		logged = logged || e.Kind == EventNotifierWaiting
+	}
+	for _, e := range hook.get() {
+		hooked = hooked || e.Kind == EventNotifierWaiting
+	}
+	if logged {
+		t.Error("status sent to the logger")
+	}
+	if !hooked {
+		t.Error("status not sent to the hooks")
+	}
+	if len(rec.get()) == 0 {
+		t.Error("other events not sent to the logger")
+	}
+}
+
+func TestShutdownWith(t *testing.T) {
+	const reason = "admin request"
+	var rec eventRecorder
+	var requested string
+	buf := &logBuffer{fn: t.Logf}
+	m := New(WithLogPrinter(buf.WriteF), WithEventHook(rec.log), WithTimeout(time.Second),
+		WithOnShutdownRequested(func(ctx string) { requested = ctx }))
+	defer close(startTimer(m, t))
+	if m.ShutdownReason() != "" {
+		t.Fatal("reason before shutdown")
+	}
+	_ = m.FirstFn(func() {})
+	m.ShutdownWith(reason)
+	// The reason of the first call is kept.
+	m.ShutdownWith("ignored")
+
+	if requested != reason {
+		t.Errorf("want requested callback with %q, got %q", reason, requested)
+	}
+	if got := m.ShutdownReason(); got != reason {
+		t.Errorf("want reason %q, got %q", reason, got)
+	}
+	events := rec.get()
+	if len(events) == 0 {
+		t.Fatal("no events")
+	}
+	for _, e := range events {
+		if e.Reason != reason {
+			t.Errorf("want reason %q on all events, got %+v", reason, e)
+		}
+	}
+	if !strings.Contains(buf.buf.String(), ": "+reason) {
+		t.Errorf("reason not logged, got %q", buf.buf.String())
+	}
+}
+
+func TestNotifierUnserviced(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeout(50*time.Millisecond))
+	defer close(startTimer(m, t))
+	_ = m.First()
+	read := m.First()
+	go func() {
+		<-read.Notify()
+		// Received, but never finished.
+	}()
+	m.Shutdown()
+
+	var unserviced []Event
+	for _, e := range rec.get() {
+		if e.Kind == EventNotifierUnserviced {
+			unserviced = append(unserviced, e)
+		}
+	}
+	if len(unserviced) != 1 {
+		t.Fatalf("want 1 unserviced notifier, got %+v", unserviced)
+	}
+	if e := unserviced[0]; e.Level != LevelWarn || !strings.Contains(e.Message, "events_test.go:") || !strings.Contains(e.Message, "never serviced") {
+		t.Errorf("unexpected event: %+v", e)
+	}
+}
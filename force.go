@@ -0,0 +1,111 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"fmt"
+	"time"
+)
+
+// ShutdownKind describes how a shutdown is proceeding. See Manager.ShutdownKind.
+type ShutdownKind int
+
+const (
+	// ShutdownGraceful is a shutdown that runs all stages.
+	// It is also returned before shutdown has started.
+	ShutdownGraceful ShutdownKind = iota
+
+	// ShutdownForced is a shutdown started or taken over by ForceShutdown,
+	// or one where stages were skipped because the hard deadline was reached.
+	ShutdownForced
+
+	// ShutdownAborted is a shutdown that was aborted with AbortShutdown.
+	// It is returned until the next shutdown starts.
+	ShutdownAborted
+)
+
+// String returns the name of the kind.
+func (k ShutdownKind) String() string {
+	switch k {
+	case ShutdownGraceful:
+		return "graceful"
+	case ShutdownForced:
+		return "forced"
+	case ShutdownAborted:
+		return "aborted"
+	}
+	return "unknown"
+}
+
+// ShutdownKind returns how the current or latest shutdown is proceeding.
+// It changes from ShutdownGraceful to ShutdownForced if ForceShutdown is called or
+// the hard deadline is reached while shutdown is running, so a completion callback
+// can use it to decide the exit code. It is safe to call at any time.
+func (m *Manager) ShutdownKind() ShutdownKind {
+	return ShutdownKind(m.kind.Load())
+}
+
+// ForceShutdown starts an emergency shutdown that only runs the force stage,
+// which is Stage3 unless another stage is set with WithForceStage.
+// Unlike Shutdown, the other stages are skipped entirely, and shutdown does not wait for locks
+// to be released, unless the force stage is the pre shutdown stage.
+// Notifiers in the skipped stages are cancelled rather than notified: they receive a notification
+// at once, which nothing waits for, and Skipped returns true for them, so they can abort fast.
+// Functions registered with for instance FirstFn are not called.
+// If a shutdown is already running, the stages that have not started yet are skipped,
+// except the force stage, and ForceShutdown waits like Shutdown. The stage that is running is not interrupted,
+// but the exit linger set with WithExitLinger is.
+func (m *Manager) ForceShutdown() {
+	m.sqM.Lock()
+	if !m.forced.Load() {
+		m.forced.Store(true)
+		m.kind.Store(int32(ShutdownForced))
+		close(m.forcedCh)
+	}
+	m.sqM.Unlock()
+	m.shutdown("forced shutdown", m.secondShutdown)
+}
+
+// cancelStage skips a stage in a forced shutdown.
+// The notifiers of the stage are removed and marked as skipped, they are sent a notification
+// that nothing waits for, and their functions are not called.
+func (m *Manager) cancelStage(stage int) {
+	m.sqM.Lock()
+	defer m.sqM.Unlock()
+	m.srM.Lock()
+	m.currentStage = Stage{stage}
+	m.stageDeadline = time.Time{}
+	m.srM.Unlock()
+
+	if len(m.shutdownQueue[stage]) > 0 {
+		m.log(Event{Level: LevelWarn, Stage: Stage{stage}, Message: fmt.Sprintf("Forced shutdown, cancelling shutdown stage %v (%s).", stage, m.StageName(Stage{stage}))})
+	}
+	if m.skippedNotifiers == nil {
+		m.skippedNotifiers = make(map[chan chan struct{}]bool)
+	}
+	internal := make(map[chan chan struct{}]bool, len(m.shutdownFnQueue[stage]))
+	for _, fn := range m.shutdownFnQueue[stage] {
+		// The goroutine of the function exits without calling it.
+		internal[fn.internal.n.c] = true
+		close(fn.cancel)
+		m.skippedNotifiers[fn.client.c] = true
+		select {
+		case fn.client.c <- make(chan struct{}):
+		default:
+		}
+		close(fn.client.c)
+	}
+	for _, n := range m.shutdownQueue[stage] {
+		delete(m.progress, n.n.c)
+		if !internal[n.n.c] {
+			// Readers close the notification, so send one rather than closing the channel.
+			m.skippedNotifiers[n.n.c] = true
+			select {
+			case n.n.c <- make(chan struct{}):
+			default:
+			}
+		}
+	}
+	m.shutdownQueue[stage] = nil
+	m.shutdownFnQueue[stage] = nil
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForceShutdown(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	// A held lock does not delay a forced shutdown.
+	_ = m.Lock()
+	f := m.First()
+	var first, third atomic.Bool
+	fn := m.SecondFn(func() { first.Store(true) })
+	m.ThirdFn(func() { third.Store(true) })
+
+	start := time.Now()
+	m.ForceShutdown()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("forced shutdown took %v", d)
+	}
+	// Readers close the notification as usual.
+	close(<-f.Notify())
+	if !f.Skipped() {
+		t.Error("notifier in a skipped stage should be skipped")
+	}
+	close(<-fn.Notify())
+	if !fn.Skipped() {
+		t.Error("function notifier in a skipped stage should be skipped")
+	}
+	if first.Load() {
+		t.Error("function in a skipped stage was called")
+	}
+	if !third.Load() {
+		t.Error("function in the force stage was not called")
+	}
+	// Cancelling a cancelled notifier has no effect.
+	f.Cancel()
+	fn.CancelWait()
+}
+
+func TestForceShutdownCancelCtx(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	ctx, cancel := m.CancelCtx(context.Background())
+	defer cancel()
+	third := m.Third()
+	go func() { close(<-third.Notify()) }()
+	m.ForceShutdown()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("context was not cancelled by the forced shutdown")
+	}
+	if third.Skipped() {
+		t.Error("notifier in the force stage should not be skipped")
+	}
+}
+
+func TestForceShutdownRunning(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithForceStage(Stage2), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	var second, third atomic.Bool
+	m.FirstFn(func() { m.ForceShutdown() })
+	m.SecondFn(func() { second.Store(true) })
+	m.ThirdFn(func() { third.Store(true) })
+	m.Shutdown()
+	if !second.Load() {
+		t.Error("function in the force stage was not called")
+	}
+	if third.Load() {
+		t.Error("function after the force stage was called")
+	}
+}
+
+func TestForceShutdownLinger(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithExitLinger(time.Minute))
+	defer close(startTimer(m, t))
+	var stage3 atomic.Bool
+	m.ThirdFn(func() { stage3.Store(true) })
+	go m.Shutdown()
+	for !stage3.Load() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Forcing a shutdown interrupts the linger.
+	start := time.Now()
+	m.ForceShutdown()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("forced shutdown waited %v for the linger", d)
+	}
+	m.Wait()
+
+	m = New(WithTimeout(time.Second), WithExitLinger(time.Minute))
+	start = time.Now()
+	m.ForceShutdown()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("forced shutdown lingered for %v", d)
+	}
+}
+
+func TestShutdownKind(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithAbortableUntil(Stage2))
+	defer close(startTimer(m, t))
+	if k := m.ShutdownKind(); k != ShutdownGraceful {
+		t.Fatalf("want %v before shutdown, got %v", ShutdownGraceful, k)
+	}
+	var during ShutdownKind
+	m.FirstFn(func() {
+		during = m.ShutdownKind()
+		m.AbortShutdown()
+	})
+	m.Shutdown()
+	if during != ShutdownGraceful {
+		t.Errorf("want %v during shutdown, got %v", ShutdownGraceful, during)
+	}
+	if k := m.ShutdownKind(); k != ShutdownAborted {
+		t.Errorf("want %v after abort, got %v", ShutdownAborted, k)
+	}
+
+	// A forced shutdown while running changes the kind.
+	var completed ShutdownKind
+	m = New(WithTimeout(time.Second), WithOnShutdownComplete(func(time.Duration) { completed = m.ShutdownKind() }))
+	m.FirstFn(func() { go m.ForceShutdown() })
+	m.SecondFn(func() { time.Sleep(50 * time.Millisecond) })
+	m.Shutdown()
+	if completed != ShutdownForced {
+		t.Errorf("want %v after ForceShutdown, got %v", ShutdownForced, completed)
+	}
+
+	// Reaching the hard deadline changes the kind.
+	m = New(WithTimeout(time.Second), WithHardDeadline(20*time.Millisecond))
+	m.FirstFn(func() { time.Sleep(50 * time.Millisecond) })
+	m.ThirdFn(func() {})
+	m.Shutdown()
+	if k := m.ShutdownKind(); k != ShutdownForced {
+		t.Errorf("want %v after the hard deadline, got %v", ShutdownForced, k)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"sync"
+)
+
+// Group registers notifiers with a manager, so they can be cancelled together,
+// for instance when a plugin is unloaded.
+// The notifiers are part of the stages of the manager like any other notifier.
+// A Group is safe for concurrent use.
+type Group struct {
+	m         *Manager
+	mu        sync.Mutex
+	notifiers []Notifier
+	pruneAt   int // Length of notifiers at which cancelled notifiers are removed
+}
+
+// NewGroup returns a new group that registers notifiers with m.
+func (m *Manager) NewGroup() *Group {
+	return &Group{m: m}
+}
+
+// add adds n to the group and returns it.
+// Notifiers that have been cancelled on their own are removed when the group
+// has doubled in size, so a long-lived group does not keep them.
+func (g *Group) add(n Notifier) Notifier {
+	if !n.Valid() {
+		return n
+	}
+	g.mu.Lock()
+	if len(g.notifiers) >= g.pruneAt {
+		g.notifiers = g.m.queued(g.notifiers)
+		g.pruneAt = 2 * (len(g.notifiers) + 1)
+	}
+	g.notifiers = append(g.notifiers, n)
+	g.mu.Unlock()
+	return n
+}
+
+// CancelAll cancels all notifiers registered with the group, like calling Cancel on each of them.
+// Notifiers registered with the manager, or with other groups, are not affected.
+// The group can still be used to register new notifiers.
+func (g *Group) CancelAll() {
+	g.mu.Lock()
+	notifiers := g.notifiers
+	g.notifiers = nil
+	g.mu.Unlock()
+	for _, n := range notifiers {
+		n.Cancel()
+	}
+}
+
+// PreShutdown is like Manager.PreShutdown, but the notifier is added to the group.
+func (g *Group) PreShutdown(ctx ...interface{}) Notifier {
+	return g.add(g.m.onShutdown(0, 1, ctx).n)
+}
+
+// PreShutdownFn is like Manager.PreShutdownFn, but the notifier is added to the group.
+func (g *Group) PreShutdownFn(fn func(), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(0, 1, func(context.Context) { fn() }, ctx))
+}
+
+// PreShutdownCtxFn is like Manager.PreShutdownCtxFn, but the notifier is added to the group.
+func (g *Group) PreShutdownCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(0, 1, fn, ctx))
+}
+
+// First is like Manager.First, but the notifier is added to the group.
+func (g *Group) First(ctx ...interface{}) Notifier {
+	return g.add(g.m.onShutdown(1, 1, ctx).n)
+}
+
+// FirstFn is like Manager.FirstFn, but the notifier is added to the group.
+func (g *Group) FirstFn(fn func(), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(1, 1, func(context.Context) { fn() }, ctx))
+}
+
+// FirstCtxFn is like Manager.FirstCtxFn, but the notifier is added to the group.
+func (g *Group) FirstCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(1, 1, fn, ctx))
+}
+
+// Second is like Manager.Second, but the notifier is added to the group.
+func (g *Group) Second(ctx ...interface{}) Notifier {
+	return g.add(g.m.onShutdown(2, 1, ctx).n)
+}
+
+// SecondFn is like Manager.SecondFn, but the notifier is added to the group.
+func (g *Group) SecondFn(fn func(), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(2, 1, func(context.Context) { fn() }, ctx))
+}
+
+// SecondCtxFn is like Manager.SecondCtxFn, but the notifier is added to the group.
+func (g *Group) SecondCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(2, 1, fn, ctx))
+}
+
+// Third is like Manager.Third, but the notifier is added to the group.
+func (g *Group) Third(ctx ...interface{}) Notifier {
+	return g.add(g.m.onShutdown(3, 1, ctx).n)
+}
+
+// ThirdFn is like Manager.ThirdFn, but the notifier is added to the group.
+func (g *Group) ThirdFn(fn func(), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(3, 1, func(context.Context) { fn() }, ctx))
+}
+
+// ThirdCtxFn is like Manager.ThirdCtxFn, but the notifier is added to the group.
+func (g *Group) ThirdCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return g.add(g.m.onFunc(3, 1, fn, ctx))
+}
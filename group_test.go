@@ -0,0 +1,81 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroupCancelAll(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	var groupCalls, otherCalls atomic.Int32
+	g := m.NewGroup()
+	g.PreShutdownFn(func() { groupCalls.Add(1) })
+	g.FirstFn(func() { groupCalls.Add(1) })
+	g.SecondFn(func() { groupCalls.Add(1) })
+	g.ThirdFn(func() { groupCalls.Add(1) })
+	g.First()
+	g.Second()
+	m.FirstFn(func() { otherCalls.Add(1) })
+	other := m.NewGroup()
+	other.SecondFn(func() { otherCalls.Add(1) })
+
+	g.CancelAll()
+	// The group can still be used after CancelAll.
+	g.ThirdFn(func() { otherCalls.Add(1) })
+	m.Shutdown()
+
+	if n := groupCalls.Load(); n != 0 {
+		t.Errorf("want no calls from the cancelled group, got %d", n)
+	}
+	if n := otherCalls.Load(); n != 3 {
+		t.Errorf("want 3 calls from other notifiers, got %d", n)
+	}
+}
+
+func TestGroupOrdering(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	g := m.NewGroup()
+	order := make(chan string, 3)
+	g.SecondFn(func() { order <- "group second" })
+	m.FirstFn(func() { order <- "manager first" })
+	g.ThirdFn(func() { order <- "group third" })
+	m.Shutdown()
+	close(order)
+	want := []string{"manager first", "group second", "group third"}
+	i := 0
+	for got := range order {
+		if got != want[i] {
+			t.Errorf("call %d: want %q, got %q", i, want[i], got)
+		}
+		i++
+	}
+}
+
+func TestGroupPrunesCancelled(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	g := m.NewGroup()
+	var calls atomic.Int32
+	g.FirstFn(func() { calls.Add(1) })
+	for i := 0; i < 100; i++ {
+		g.SecondFn(func() { calls.Add(1) }).Cancel()
+		g.Third().Cancel()
+	}
+	g.mu.Lock()
+	held := len(g.notifiers)
+	g.mu.Unlock()
+	if held > 10 {
+		t.Errorf("want cancelled notifiers removed from the group, %d held", held)
+	}
+	// The notifier that was not cancelled is still part of the group.
+	g.CancelAll()
+	m.Shutdown()
+	if n := calls.Load(); n != 0 {
+		t.Errorf("want no calls, got %d", n)
+	}
+}
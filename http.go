@@ -3,41 +3,286 @@
 package shutdown
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
 )
 
 // WrapHandler will return an http Handler
 // That will lock shutdown until all have completed
 // and will return http.StatusServiceUnavailable if
-// shutdown has been initiated.
+// shutdown has been initiated, or the status set with WithUnavailableStatus.
+// If the context of the request is already done, because the client
+// has gone away, the handler returns at once without taking a lock
+// or calling h. Nothing is written, since no one is left to read the response.
 func (m *Manager) WrapHandler(h http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		l := m.Lock()
+	return m.wrap(h)
+}
+
+// WrapHandlerNamed is like WrapHandler, but the locks held by the handler
+// are tagged with name. The name is included in the context of lock timeouts
+// and given to the function set with WithOnTimeout, so it is possible to tell
+// which handler is blocking shutdown when several handlers are wrapped.
+// Like WrapHandler, it returns at once if the context of the request is already done.
+func (m *Manager) WrapHandlerNamed(h http.Handler, name string) http.Handler {
+	return m.wrap(h, name)
+}
+
+// WrapHandlerFunc will return an http.HandlerFunc
+// that will lock shutdown until all have completed.
+// The handler will return http.StatusServiceUnavailable, or the status
+// set with WithUnavailableStatus, if shutdown has been initiated. Like WrapHandler, it returns at once
+// if the context of the request is already done.
+func (m *Manager) WrapHandlerFunc(h http.HandlerFunc) http.HandlerFunc {
+	return m.wrap(h)
+}
+
+// wrap returns a handler that serves h while holding a lock tagged with ctx.
+func (m *Manager) wrap(h http.Handler, ctx ...interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Err() != nil {
+			return
+		}
+		l, _ := m.lock(0, ctx)
 		if l == nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
+			w.WriteHeader(m.unavailableStatus)
 			return
 		}
 		// We defer, so panics will not keep a lock
 		defer l()
 		h.ServeHTTP(w, r)
 	}
-	return http.HandlerFunc(fn)
 }
 
-// WrapHandlerFunc will return an http.HandlerFunc
-// that will lock shutdown until all have completed.
-// The handler will return http.StatusServiceUnavailable if
-// shutdown has been initiated.
-func (m *Manager) WrapHandlerFunc(h http.HandlerFunc) http.HandlerFunc {
+// WrapHandlerDrain will return an http Handler
+// that will lock shutdown until all requests have completed, like WrapHandler.
+// When shutdown has been initiated new requests are still served until the
+// grace window has elapsed, so health checks can fail first and load balancers
+// stop routing requests before they are rejected.
+// After the grace window new requests get http.StatusServiceUnavailable,
+// or the status set with WithUnavailableStatus.
+// The pre shutdown stage will not finish while requests are being served,
+// so the grace window should be shorter than the pre shutdown timeout.
+// If the shutdown is aborted, see AbortShutdown, new requests are served again
+// and the grace window applies to the next shutdown.
+// Like WrapHandler, it returns at once if the context of the request is already done.
+func (m *Manager) WrapHandlerDrain(h http.Handler, grace time.Duration) http.Handler {
+	var mu sync.RWMutex
+	var rejecting bool
+	var wg sync.WaitGroup
+	var arm func()
+	arm = func() {
+		mu.Lock()
+		defer mu.Unlock()
+		rejecting = false
+		n := m.PreShutdownCtxFn(func(ctx context.Context) {
+			t := m.clock.NewTimer(grace)
+			select {
+			case <-t.C():
+			case <-ctx.Done():
+			}
+			t.Stop()
+			mu.Lock()
+			rejecting = true
+			mu.Unlock()
+			wg.Wait()
+			// The notifier is removed if the shutdown is aborted, so register again.
+			m.sqM.Lock()
+			aborted := m.abortedCh
+			m.sqM.Unlock()
+			go func() {
+				select {
+				case <-aborted:
+					arm()
+				case <-m.shutdownFinished:
+				}
+			}()
+		}, "WrapHandlerDrain")
+		if !n.Valid() {
+			// Shutdown has already started.
+			rejecting = true
+		}
+	}
+	arm()
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		l := m.Lock()
-		if l == nil {
-			w.WriteHeader(http.StatusServiceUnavailable)
+		if r.Context().Err() != nil {
 			return
 		}
-		// We defer, so panics will not keep a lock
-		defer l()
-		h(w, r)
+		if l := m.Lock(); l != nil {
+			// We defer, so panics will not keep a lock
+			defer l()
+			h.ServeHTTP(w, r)
+			return
+		}
+		mu.RLock()
+		if rejecting {
+			mu.RUnlock()
+			w.WriteHeader(m.unavailableStatus)
+			return
+		}
+		wg.Add(1)
+		mu.RUnlock()
+		defer wg.Done()
+		h.ServeHTTP(w, r)
 	}
 	return http.HandlerFunc(fn)
 }
+
+// checkUnavailableStatus replaces an invalid status set with WithUnavailableStatus
+// with http.StatusServiceUnavailable.
+func (m *Manager) checkUnavailableStatus() {
+	if m.unavailableStatus < 400 || m.unavailableStatus > 599 {
+		m.log(Event{Level: LevelWarn, Message: fmt.Sprintf("Invalid unavailable status %d, using %d", m.unavailableStatus, http.StatusServiceUnavailable)})
+		m.unavailableStatus = http.StatusServiceUnavailable
+	}
+}
+
+// WrapRoundTripper returns an http.RoundTripper that locks shutdown while outbound requests are in flight,
+// like WrapHandler does for inbound requests. The lock is held until the response body has been
+// read to the end or closed, so the body must be closed as usual.
+// Once shutdown has been initiated new requests are rejected with ErrShuttingDown,
+// which http.Client wraps in a *url.Error, so check it with errors.Is.
+// If rt is nil, http.DefaultTransport is used.
+func (m *Manager) WrapRoundTripper(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return roundTripper{m: m, rt: rt}
+}
+
+type roundTripper struct {
+	m  *Manager
+	rt http.RoundTripper
+}
+
+func (t roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	unlock, err := t.m.lock(1, []interface{}{"RoundTrip", r.Method, r.URL.Host})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.rt.RoundTrip(r)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	body := lockedBody{ReadCloser: resp.Body, unlock: unlock}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// Keep the body writable for protocol upgrades.
+		resp.Body = lockedRWBody{lockedBody: body, w: rw}
+	} else {
+		resp.Body = body
+	}
+	return resp, nil
+}
+
+// lockedBody releases a lock when the body has been read or closed.
+type lockedBody struct {
+	io.ReadCloser
+	unlock func()
+}
+
+func (b lockedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.unlock()
+	}
+	return n, err
+}
+
+func (b lockedBody) Close() error {
+	defer b.unlock()
+	return b.ReadCloser.Close()
+}
+
+type lockedRWBody struct {
+	lockedBody
+	w io.Writer
+}
+
+func (b lockedRWBody) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// ManageServer will shut down srv in stage s.
+// The handler of the server is wrapped with WrapHandler, so requests in flight
+// lock shutdown and new requests are rejected once shutdown has started.
+// Use WithoutHandlerWrap to keep the handler as it is.
+// In stage s srv.Shutdown is called with a context that is cancelled
+// when the timeout of the stage expires, after which remaining connections are closed.
+// ManageServer must be called before the server is started.
+// The returned notifier can be used to cancel the shutdown of the server.
+func (m *Manager) ManageServer(srv *http.Server, s Stage, opts ...ServerOption) Notifier {
+	var o serverOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.noWrap {
+		h := srv.Handler
+		if h == nil {
+			h = http.DefaultServeMux
+		}
+		srv.Handler = m.WrapHandler(h)
+	}
+	return m.onFunc(s.n, 1, func(ctx context.Context) {
+		if err := srv.Shutdown(ctx); err != nil {
+			m.log(Event{Level: LevelWarn, Stage: s, Context: srv.Addr, Message: fmt.Sprintf("Error shutting down http.Server: %v", err)})
+			srv.Close()
+		}
+	}, []interface{}{"http.Server " + srv.Addr})
+}
+
+// ReadinessHandler returns an http Handler for readiness probes.
+// It returns http.StatusOK until shutdown is requested, and http.StatusServiceUnavailable after.
+// Shutdown counts as requested as soon as Shutdown is called, also while functions added
+// with OnBeforeShutdown and the delay set with WithPreDrainDelay run, so load balancers
+// can stop routing requests before the service stops accepting them.
+// If the request accepts application/json, the status and current stage are written as JSON.
+func (m *Manager) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.probe(w, r, m.shutdownCalled.Load())
+	})
+}
+
+// LivenessHandler returns an http Handler for liveness probes.
+// It returns http.StatusOK until shutdown has finished, and http.StatusServiceUnavailable after,
+// when the process is about to exit.
+// If the request accepts application/json, the status and current stage are written as JSON.
+func (m *Manager) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.sqM.Lock()
+		finished := m.finished()
+		m.sqM.Unlock()
+		m.probe(w, r, finished)
+	})
+}
+
+// probeStatus is the JSON body written by the probe handlers.
+type probeStatus struct {
+	Status string `json:"status"`
+	Stage  *int   `json:"stage,omitempty"`
+}
+
+// probe writes the response of a probe handler.
+func (m *Manager) probe(w http.ResponseWriter, r *http.Request, failing bool) {
+	code, status := http.StatusOK, "ok"
+	if failing {
+		code, status = http.StatusServiceUnavailable, "shutting down"
+	}
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.WriteHeader(code)
+		return
+	}
+	body := probeStatus{Status: status}
+	if s, ok := m.CurrentStage(); ok {
+		i := s.Index()
+		body.Stage = &i
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
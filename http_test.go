@@ -4,8 +4,12 @@ package shutdown
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -46,6 +50,94 @@ func TestWrapHandlerBasic(t *testing.T) {
 	}
 }
 
+func TestWrapHandlerCancelledRequest(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	var called bool
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	for _, h := range []http.Handler{m.WrapHandler(fn), m.WrapHandlerNamed(fn, "named"), m.WrapHandlerFunc(fn), m.WrapHandlerDrain(fn, 0)} {
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	if called {
+		t.Error("handler called for a cancelled request")
+	}
+	if got := m.Metrics().LockAcquisitions; got != 0 {
+		t.Errorf("want no locks acquired, got %d", got)
+	}
+}
+
+func TestWithUnavailableStatus(t *testing.T) {
+	m := New(WithUnavailableStatus(http.StatusTooManyRequests), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	m.Shutdown()
+	for _, h := range []http.Handler{m.WrapHandler(fn), m.WrapHandlerNamed(fn, "named"), m.WrapHandlerFunc(fn)} {
+		res := httptest.NewRecorder()
+		h.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+		if res.Code != http.StatusTooManyRequests {
+			t.Errorf("want status %d, got %d", http.StatusTooManyRequests, res.Code)
+		}
+	}
+
+	var rec eventRecorder
+	m = New(WithUnavailableStatus(http.StatusOK), WithLogger(rec.log))
+	if m.unavailableStatus != http.StatusServiceUnavailable {
+		t.Errorf("want invalid status replaced with %d, got %d", http.StatusServiceUnavailable, m.unavailableStatus)
+	}
+	if events := rec.get(); len(events) != 1 || events[0].Level != LevelWarn {
+		t.Errorf("want a warning, got %v", events)
+	}
+}
+
+func TestWrapHandlerNamed(t *testing.T) {
+	timedOut := make(chan string, 1)
+	m := New(WithTimeoutN(StagePS, 50*time.Millisecond), WithTimeoutN(Stage1, time.Second),
+		WithTimeoutN(Stage2, time.Second), WithTimeoutN(Stage3, time.Second),
+		WithLogger(nil), WithOnTimeout(func(s Stage, ctx string) {
+			select {
+			case timedOut <- ctx:
+			default:
+			}
+		}))
+	defer close(startTimer(m, t))
+	release := make(chan struct{})
+	started := make(chan struct{})
+	wrapped := m.WrapHandlerNamed(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), "api")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req, _ := http.NewRequest("", "", bytes.NewBufferString(""))
+		wrapped.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	<-started
+	m.Shutdown()
+	close(release)
+	<-done
+	select {
+	case ctx := <-timedOut:
+		if !strings.Contains(ctx, "api") {
+			t.Errorf("lock context does not contain the handler name: %q", ctx)
+		}
+	default:
+		t.Fatal("lock did not time out")
+	}
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("", "", bytes.NewBufferString(""))
+	wrapped.ServeHTTP(res, req)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Fatal("Expected result code to be", http.StatusServiceUnavailable, " got", res.Code)
+	}
+}
+
 func TestWrapHandlerFuncBasic(t *testing.T) {
 	m := newTestTimer()
 	defer close(startTimer(m, t))
@@ -77,6 +169,185 @@ func TestWrapHandlerFuncBasic(t *testing.T) {
 	}
 }
 
+func TestWrapHandlerDrain(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	release := make(chan struct{})
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+	})
+	wrapped := m.WrapHandlerDrain(fn, 100*time.Millisecond)
+	serve := func(path string) int {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("", path, bytes.NewBufferString(""))
+		wrapped.ServeHTTP(res, req)
+		return res.Code
+	}
+	if code := serve("/"); code != http.StatusOK {
+		t.Fatal("Expected result code to be", http.StatusOK, "got", code)
+	}
+
+	go m.Shutdown()
+	time.Sleep(20 * time.Millisecond)
+	if !m.Started() {
+		t.Fatal("shutdown should be started")
+	}
+	// Within the grace window requests are still served.
+	blocked := make(chan int)
+	go func() { blocked <- serve("/block") }()
+	if code := serve("/"); code != http.StatusOK {
+		t.Fatal("Expected result code during grace window to be", http.StatusOK, "got", code)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if code := serve("/"); code != http.StatusServiceUnavailable {
+		t.Fatal("Expected result code after grace window to be", http.StatusServiceUnavailable, "got", code)
+	}
+	// The pre shutdown stage must wait for the request in flight.
+	if s, _ := m.CurrentStage(); s != StagePS {
+		t.Fatal("Expected pre shutdown stage, got", s)
+	}
+	close(release)
+	if code := <-blocked; code != http.StatusOK {
+		t.Fatal("Expected blocked request to succeed, got", code)
+	}
+	m.Wait()
+}
+
+func TestWrapHandlerDrainAbort(t *testing.T) {
+	m := New(WithAbortableUntil(Stage2), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	wrapped := m.WrapHandlerDrain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 100*time.Millisecond)
+	serve := func() int {
+		res := httptest.NewRecorder()
+		wrapped.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+		return res.Code
+	}
+	m.FirstFn(func() { m.AbortShutdown() })
+	m.Shutdown()
+	if m.Started() {
+		t.Fatal("shutdown should be aborted")
+	}
+	// Wait for the handler to register for the next shutdown.
+	for i := 0; ; i++ {
+		m.sqM.Lock()
+		queued := len(m.shutdownQueue[StagePS.n])
+		m.sqM.Unlock()
+		if queued > 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("handler did not register again after abort")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go m.Shutdown()
+	time.Sleep(20 * time.Millisecond)
+	if code := serve(); code != http.StatusOK {
+		t.Fatal("Expected result code during grace window after abort to be", http.StatusOK, "got", code)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if code := serve(); code != http.StatusServiceUnavailable {
+		t.Fatal("Expected result code after grace window to be", http.StatusServiceUnavailable, "got", code)
+	}
+	m.Wait()
+}
+
+func TestWrapRoundTripper(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello")
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: m.WrapRoundTripper(nil)}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := m.LocksHeld(); got != 1 {
+		t.Fatalf("want 1 lock held until the body is closed, got %d", got)
+	}
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("shutdown finished with a response in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("want body hello, got %q", body)
+	}
+	<-done
+
+	_, err = client.Get(srv.URL)
+	if !errors.Is(err, ErrShuttingDown) {
+		t.Fatalf("want ErrShuttingDown after shutdown, got %v", err)
+	}
+}
+
+func TestManageServer(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer ts.Close()
+	n := m.ManageServer(ts.Config, Stage2)
+	if !n.Valid() {
+		t.Fatal("notifier should be valid")
+	}
+	ts.Start()
+
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("want body %q, got %q", "ok", body)
+	}
+
+	m.Shutdown()
+	if _, err = http.Get(ts.URL); err == nil {
+		t.Fatal("server should be shut down")
+	}
+}
+
+func TestManageServerWithoutHandlerWrap(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	h := http.NewServeMux()
+	srv := &http.Server{Handler: h}
+	if n := m.ManageServer(srv, Stage2, WithoutHandlerWrap()); !n.Valid() {
+		t.Fatal("notifier should be valid")
+	}
+	if srv.Handler != h {
+		t.Errorf("want handler kept, got %T", srv.Handler)
+	}
+	nilSrv := &http.Server{}
+	m.ManageServer(nilSrv, Stage2, WithoutHandlerWrap())
+	if nilSrv.Handler != nil {
+		t.Errorf("want nil handler kept, got %T", nilSrv.Handler)
+	}
+	wrapped := &http.Server{Handler: h}
+	m.ManageServer(wrapped, Stage2)
+	if wrapped.Handler == h {
+		t.Error("handler not wrapped without WithoutHandlerWrap")
+	}
+	m.Shutdown()
+}
+
 // Test if panics locks shutdown.
 func TestWrapHandlerPanic(t *testing.T) {
 	m := New(WithTimeout(time.Second))
@@ -291,3 +562,59 @@ func ExampleWrapHandler() {
 	http.ListenAndServe(":8080", nil)
 }
 */
+
+func TestProbeHandlers(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	ready, live := m.ReadinessHandler(), m.LivenessHandler()
+	probe := func(h http.Handler, accept string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		h.ServeHTTP(res, req)
+		return res
+	}
+	if c := probe(ready, "").Code; c != http.StatusOK {
+		t.Errorf("readiness before shutdown: want %d, got %d", http.StatusOK, c)
+	}
+	if c := probe(live, "").Code; c != http.StatusOK {
+		t.Errorf("liveness before shutdown: want %d, got %d", http.StatusOK, c)
+	}
+
+	release := make(chan struct{})
+	inStage := make(chan struct{})
+	m.FirstFn(func() {
+		close(inStage)
+		<-release
+	})
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	<-inStage
+	if c := probe(ready, "").Code; c != http.StatusServiceUnavailable {
+		t.Errorf("readiness during shutdown: want %d, got %d", http.StatusServiceUnavailable, c)
+	}
+	res := probe(live, "application/json")
+	if res.Code != http.StatusOK {
+		t.Errorf("liveness during shutdown: want %d, got %d", http.StatusOK, res.Code)
+	}
+	if got := strings.TrimSpace(res.Body.String()); got != `{"status":"ok","stage":1}` {
+		t.Errorf("unexpected body %q", got)
+	}
+	if res.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected content type %q", res.Header().Get("Content-Type"))
+	}
+	close(release)
+	<-done
+	res = probe(live, "application/json")
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("liveness after shutdown: want %d, got %d", http.StatusServiceUnavailable, res.Code)
+	}
+	if got := strings.TrimSpace(res.Body.String()); got != `{"status":"shutting down"}` {
+		t.Errorf("unexpected body %q", got)
+	}
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ManageListener will close l in stage s, so Accept returns and accept loops can exit.
+// The address of the listener is used as context for the notifier.
+// If the listener has already been closed when the stage runs, nothing is logged.
+// The returned notifier can be used to cancel closing the listener.
+func (m *Manager) ManageListener(l net.Listener, s Stage) Notifier {
+	return m.onFunc(s.n, 1, func(context.Context) {
+		if err := l.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			m.log(Event{Level: LevelWarn, Stage: s, Context: l.Addr().String(), Message: fmt.Sprintf("Error closing listener: %v", err)})
+		}
+	}, []interface{}{"net.Listener " + l.Addr().String()})
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManageListener(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := m.ManageListener(l, Stage1)
+	if !n.Valid() {
+		t.Fatal("notifier should be valid")
+	}
+
+	accepted := make(chan error)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				accepted <- err
+				return
+			}
+			c.Close()
+		}
+	}()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	m.Shutdown()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("Accept did not return")
+	}
+	// Closing again must be harmless.
+	if err := l.Close(); err == nil {
+		t.Error("listener should already be closed")
+	}
+	for _, e := range rec.get() {
+		if e.Level != LevelInfo && strings.Contains(e.Context, l.Addr().String()) {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	}
+}
+
+func TestManageListenerClosed(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.ManageListener(l, Stage1)
+	l.Close()
+	m.Shutdown()
+	for _, e := range rec.get() {
+		if e.Level != LevelInfo {
+			t.Errorf("closing a closed listener should not log, got %+v", e)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package shutdown
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -34,28 +39,156 @@ func New(options ...Option) *Manager {
 		warningPrefix:       "WARN: ",
 		errorPrefix:         "ERROR: ",
 		logLockTimeouts:     true,
+		lockTracking:        true,
+		clock:               realClock{},
 		currentStage:        Stage{-1},
 		shutdownFinished:    make(chan struct{}),
 		shutdownRequestedCh: make(chan struct{}),
+		abortedCh:           make(chan struct{}),
+		forcedCh:            make(chan struct{}),
+		forceStage:          Stage{3},
+		stageNames:          defaultStageNames,
+		bestEffortTimeout:   time.Second,
+		unavailableStatus:   http.StatusServiceUnavailable,
+		timeout:             5 * time.Second,
 		timeouts:            [4]time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second, 5 * time.Second},
-		logger:              LogPrinter(log.New(os.Stderr, "[shutdown]: ", log.LstdFlags)),
 	}
+	for i := range m.stageDone {
+		m.stageDone[i] = make(chan struct{})
+	}
+	loggerOption(func(m *Manager) func(Event) {
+		return m.printer(log.New(os.Stderr, "[shutdown]: ", log.LstdFlags))
+	})(m)
 
 	for _, option := range options {
 		option(m)
 	}
+	m.checkTimeouts()
+	m.checkUnavailableStatus()
+	m.created = m.clock.Now()
+	m.watchTrigger()
 	return m
 }
 
-// Manager encapsulates all state/settings previously stored at package level
+// NewScope returns a new manager with the same configuration as m,
+// like timeouts, logger and callbacks, but with its own notifiers and lifecycle.
+// Shutting down the returned manager does not affect m, and shutting down m
+// does not affect the returned manager.
+// The options are applied after the configuration has been copied, and also apply
+// to the logger of the parent, so for instance WithWarningPrefix changes the prefix of the scope.
+// A scope of a manager returned by NewForTesting keeps its own events, see Events.
+func (m *Manager) NewScope(options ...Option) *Manager {
+	c := New()
+	c.performOSExit = m.performOSExit
+	c.secondShutdown = m.secondShutdown
+	c.panicPolicy = m.panicPolicy
+	c.minUptime = m.minUptime
+	c.minUptimeReject = m.minUptimeReject
+	c.forceStage = m.forceStage
+	c.logLockTimeouts = m.logLockTimeouts
+	c.lockTracking = m.lockTracking
+	c.warningPrefix = m.warningPrefix
+	c.errorPrefix = m.errorPrefix
+	c.statusTimer = m.statusTimer
+	c.statusEscalation = m.statusEscalation
+	c.statusWriter = m.statusWriter
+	c.summary = m.summary
+	// The logger is built again, so it uses the options of the scope, like the prefixes.
+	m.logM.RLock()
+	newLogger := m.newLogger
+	m.logM.RUnlock()
+	loggerOption(newLogger)(c)
+	if m.testEvents != nil {
+		// A scope of a manager returned by NewForTesting keeps its own events.
+		c.testEvents = &eventLog{}
+	}
+	c.hooks = append([]func(Event){}, m.hooks...)
+	if m.recent != nil {
+		c.recent = newEventRing(len(m.recent.events))
+	}
+	c.stuckDump = m.stuckDump
+	c.clock = m.clock
+	c.preDrainDelay = m.preDrainDelay
+	c.exitLinger = m.exitLinger
+	c.bestEffortTimeout = m.bestEffortTimeout
+	c.unavailableStatus = m.unavailableStatus
+	c.onTimeOut = m.onTimeOut
+	c.onShutdownRequested = m.onShutdownRequested
+	c.onStageComplete = m.onStageComplete
+	c.onShutdownComplete = m.onShutdownComplete
+	c.onComplete = m.onComplete
+	c.onPanic = m.onPanic
+
+	m.sqM.Lock()
+	c.stageModes = m.stageModes
+	c.stageNames = m.stageNames
+	c.stageConcurrency = m.stageConcurrency
+	if m.shuffle != nil {
+		c.shuffleSeed = m.shuffleSeed
+		c.shuffle = rand.New(rand.NewSource(m.shuffleSeed))
+	}
+	c.timeoutPolicies = m.timeoutPolicies
+	c.skipped = m.skipped
+	c.abortable = m.abortable
+	c.abortableUntil = m.abortableUntil
+	m.sqM.Unlock()
+
+	m.srM.RLock()
+	c.timeout = m.timeout
+	c.timeouts = m.timeouts
+	c.hardDeadline = m.hardDeadline
+	c.adaptiveBase = m.adaptiveBase
+	c.adaptivePerLock = m.adaptivePerLock
+	c.lockLease = m.lockLease
+	c.drainLocks = m.drainLocks
+	m.srM.RUnlock()
+
+	for _, option := range options {
+		option(c)
+	}
+	c.checkTimeouts()
+	c.checkUnavailableStatus()
+	c.created = c.clock.Now()
+	c.watchTrigger()
+	return c
+}
+
+// Manager encapsulates all state/settings previously stored at package level.
+// Managers are independent of each other, so several can be used to give
+// subsystems their own shutdown lifecycle.
 type Manager struct {
 	// performOSExit calls os.Exit() when shutdown is complete, if set to true.
 	performOSExit bool
 
+	// exitAfter calls os.Exit(exitAfterCode) when shutdown is complete, see WithExitAfter.
+	exitAfter     bool
+	exitAfterCode int
+
+	// panicPolicy controls what happens when a panic is recovered in a shutdown function.
+	panicPolicy PanicPolicy
+
+	// triggerCtx starts shutdown when it is done, if set.
+	triggerCtx context.Context
+
+	// created is the time the manager was created, used for the minimum uptime.
+	created time.Time
+
+	// minUptime is the minimum time from the manager is created until shutdown can start.
+	minUptime time.Duration
+
+	// minUptimeReject rejects shutdowns before minUptime instead of delaying them.
+	minUptimeReject bool
+
+	// secondShutdown controls what calls to Shutdown do while a shutdown is running.
+	secondShutdown SecondShutdownMode
+
 	// logLockTimeouts enables log timeout warnings
 	// and notifier status updates.
 	logLockTimeouts bool
 
+	// lockTracking records the caller of each lock, if logLockTimeouts is enabled.
+	lockTracking bool
+
 	// warningPrefix is printed before warnings.
 	warningPrefix string
 
@@ -66,23 +199,120 @@ type Manager struct {
 	// Should not be changed once shutdown has started.
 	statusTimer time.Duration
 
+	// statusEscalation is the number of status intervals before escalating. 0 disables escalation.
+	statusEscalation int
+
+	// statusWriter receives the output of the status timer instead of the logger, if set.
+	statusWriter io.Writer
+
+	// summary logs a summary when shutdown has completed, if set to true.
+	summary bool
+
 	// logger used for output.
-	// This can be exchanged with your own using WithLogPrinter option.
-	logger LogPrinter
+	// This can be exchanged with your own using WithLogPrinter or WithLogger option,
+	// or SetLogPrinter and SetLogger. Protected by logM.
+	logM      sync.RWMutex
+	logger    func(Event)
+	newLogger func(m *Manager) func(Event) // Builds logger, see loggerOption
+
+	// hooks receive all events in addition to the logger.
+	hooks []func(Event)
+
+	// recent keeps the most recent events, if enabled with WithEventBuffer.
+	recent *eventRing
+
+	// stuckDump receives a goroutine dump when a stage times out, if set.
+	stuckDump io.Writer
+
+	// clock is used for all timeouts and timers.
+	clock Clock
 
 	sqM              sync.Mutex // Mutex for below
 	shutdownQueue    [4][]iNotifier
 	shutdownFnQueue  [4][]fnNotify
-	shutdownFinished chan struct{} // Closed when shutdown has finished
+	shutdownFinished chan struct{}    // Closed when shutdown has finished
+	stageDone        [4]chan struct{} // Closed when each stage has finished
 	currentStage     Stage
+	stageDeadline    time.Time          // When the current stage times out, zero if it has no timeout
+	stageCtx         [4]context.Context // Cancelled when the stage times out
+	stageModes       [4]StageMode
+	stageNames       [4]string  // Names of the stages, see WithStageNames
+	stageConcurrency [4]int     // Max notifiers notified at once, see WithStageConcurrency
+	shuffle          *rand.Rand // Shuffles the notifiers within a priority group, see WithIntraStageShuffle
+	shuffleSeed      int64
+	timeoutPolicies  [4]TimeoutPolicy
+	skipped          [4]bool                         // Stages that are never run, see WithSkipStages
+	progress         map[chan chan struct{}]progress // Latest progress reported by notifiers
+	skippedNotifiers map[chan chan struct{}]bool     // Notifiers cancelled by a forced shutdown, see Skipped
+	abortable        bool                            // Shutdown can be aborted before abortableUntil
+	abortableUntil   Stage
+	abortRequested   bool
+	abortedCh        chan struct{} // Closed when a shutdown is aborted
+	stagesRun        int           // Stages that have notified notifiers, for the summary
+	timedOutCount    int           // Notifiers that did not finish before their stage timed out
+	transitions      []chan Stage  // Receive each stage as it begins, see Transitions
+
+	beforeShutdown []func()      // Run before shutdown is marked as started
+	forced         atomic.Bool   // Only the force stage is run, see ForceShutdown
+	forcedCh       chan struct{} // Closed when forced is set, protected by sqM
+	kind           atomic.Int32  // The ShutdownKind of the current or latest shutdown
+	forceStage     Stage
+	preDrainDelay  time.Duration
+	exitLinger     time.Duration // Delay after the last stage, see WithExitLinger
+
+	// unavailableStatus is the status of requests rejected by the wrapped handlers.
+	unavailableStatus int
+
+	// bestEffortTimeout is the timeout of notifiers registered with BestEffort.
+	bestEffortTimeout time.Duration
+	shutdownCalled    atomic.Bool
+	reason            atomic.Value // Reason of the shutdown, see ShutdownWith
 
 	srM                 sync.RWMutex // Mutex for below
 	shutdownRequested   atomic.Bool
 	shutdownRequestedCh chan struct{}
 	wg                  sync.WaitGroup
+	locksHeld           atomic.Int32 // Number of locks that have not been released or expired
+
+	timeout             time.Duration // Last timeout set for all stages
+	timeouts            [4]time.Duration
+	adaptiveBase        time.Duration    // Base of the adaptive timeout, see WithAdaptiveTimeout
+	adaptivePerLock     time.Duration    // Added to the adaptive timeout per held lock, zero if disabled
+	lockLease           time.Duration    // Maximum time a lock is held, zero to use the pre shutdown timeout
+	drainLocks          [4]time.Duration // Time to wait for locks to be released before each stage, see WithDrainLocksBefore
+	hardDeadline        time.Duration    // Maximum time from Shutdown is called until it has finished
+	deadline            time.Time        // Deadline for the shutdown, zero if none
+	onTimeOut           func(s Stage, ctx string, elapsed time.Duration, reason string)
+	onShutdownRequested func(ctx string)
+	onStageComplete     func(s Stage, d time.Duration, timedOut bool)
+	onShutdownComplete  func(total time.Duration)
+	onComplete          func(total time.Duration, err error)
+	onPanic             func(s Stage, ctx string, recovered interface{}, stack []byte)
+
+	lockM sync.Mutex                 // Mutex for below
+	locks map[chan struct{}]heldLock // Locks that have not been released, by release channel
+
+	testEvents *eventLog // Events kept by managers returned by NewForTesting
+
+	steps     chan struct{} // Runs the next stage, see StepShutdown. Protected by sqM
+	stepped   chan bool     // Sent when a stepped stage has completed
+	stepsDone atomic.Bool   // The stepped shutdown has finished
 
-	timeouts  [4]time.Duration
-	onTimeOut func(s Stage, ctx string)
+	lockWaiter Notifier // Waits for the locks in the pre shutdown stage. Protected by sqM
+
+	reentM    sync.Mutex     // Mutex for below
+	reentrant map[uint64]int // Goroutines running the shutdown or its functions, see inShutdown
+
+	childM   sync.Mutex // Mutex for below
+	children []*Manager // Managers added with AddChild
+
+	errM    sync.Mutex // Mutex for below
+	errs    []error
+	repanic *PanicError // Panic to repanic with after the stage, see PanicRepanic
+
+	metricsM       sync.Mutex // Mutex for below
+	metrics        Metrics
+	stageTimedOuts [4]bool // Stages that timed out in the latest shutdown
 }
 
 // PreShutdown will return a Notifier that will be fired as soon as the shutdown.
@@ -98,7 +328,7 @@ func (m *Manager) PreShutdown(ctx ...interface{}) Notifier {
 // This allows to for instance send signals to upstream servers not to send more requests.
 // The context is printed if LogLockTimeouts is enabled.
 func (m *Manager) PreShutdownFn(fn func(), ctx ...interface{}) Notifier {
-	return m.onFunc(0, 1, fn, ctx)
+	return m.onFunc(0, 1, func(context.Context) { fn() }, ctx)
 }
 
 // First returns a notifier that will be called in the first stage of shutdowns.
@@ -112,7 +342,7 @@ func (m *Manager) First(ctx ...interface{}) Notifier {
 // If shutdown has started and this stage has already been reached, the notifiers Valid() will be false.
 // The context is printed if LogLockTimeouts is enabled.
 func (m *Manager) FirstFn(fn func(), ctx ...interface{}) Notifier {
-	return m.onFunc(1, 1, fn, ctx)
+	return m.onFunc(1, 1, func(context.Context) { fn() }, ctx)
 }
 
 // Second returns a notifier that will be called in the second stage of shutdowns.
@@ -126,7 +356,7 @@ func (m *Manager) Second(ctx ...interface{}) Notifier {
 // If shutdown has started and this stage has already been reached, the notifiers Valid() will be false.
 // The context is printed if LogLockTimeouts is enabled.
 func (m *Manager) SecondFn(fn func(), ctx ...interface{}) Notifier {
-	return m.onFunc(2, 1, fn, ctx)
+	return m.onFunc(2, 1, func(context.Context) { fn() }, ctx)
 }
 
 // Third returns a notifier that will be called in the third stage of shutdowns.
@@ -140,9 +370,153 @@ func (m *Manager) Third(ctx ...interface{}) Notifier {
 // If shutdown has started and this stage has already been reached, the notifiers Valid() will be false.
 // The context is printed if LogLockTimeouts is enabled.
 func (m *Manager) ThirdFn(fn func(), ctx ...interface{}) Notifier {
+	return m.onFunc(3, 1, func(context.Context) { fn() }, ctx)
+}
+
+// PreShutdownFnIf is like PreShutdownFn, but cond is called when the stage runs,
+// and fn is only executed if cond returns true.
+// This can be used for cleanup that is only needed if a subsystem was initialized.
+func (m *Manager) PreShutdownFnIf(cond func() bool, fn func(), ctx ...interface{}) Notifier {
+	return m.onFunc(0, 1, condFn(cond, fn), ctx)
+}
+
+// FirstFnIf is like FirstFn, but cond is called when the stage runs,
+// and fn is only executed if cond returns true.
+// This can be used for cleanup that is only needed if a subsystem was initialized.
+func (m *Manager) FirstFnIf(cond func() bool, fn func(), ctx ...interface{}) Notifier {
+	return m.onFunc(1, 1, condFn(cond, fn), ctx)
+}
+
+// SecondFnIf is like SecondFn, but cond is called when the stage runs,
+// and fn is only executed if cond returns true.
+// This can be used for cleanup that is only needed if a subsystem was initialized.
+func (m *Manager) SecondFnIf(cond func() bool, fn func(), ctx ...interface{}) Notifier {
+	return m.onFunc(2, 1, condFn(cond, fn), ctx)
+}
+
+// ThirdFnIf is like ThirdFn, but cond is called when the stage runs,
+// and fn is only executed if cond returns true.
+// This can be used for cleanup that is only needed if a subsystem was initialized.
+func (m *Manager) ThirdFnIf(cond func() bool, fn func(), ctx ...interface{}) Notifier {
+	return m.onFunc(3, 1, condFn(cond, fn), ctx)
+}
+
+// PreShutdownSignal closes ch in the pre shutdown stage.
+// See FirstSignal.
+func (m *Manager) PreShutdownSignal(ch chan<- struct{}, ctx ...interface{}) Notifier {
+	return m.onFunc(0, 1, func(context.Context) { close(ch) }, ctx)
+}
+
+// FirstSignal closes ch in the first stage of the shutdown.
+// This is for notifications where completion is tracked elsewhere:
+// the stage does not wait for anything after ch has been closed,
+// so there is no back-pressure from the receivers.
+// ch must not be closed by anything else.
+// The returned notifier can be used to cancel the notification.
+func (m *Manager) FirstSignal(ch chan<- struct{}, ctx ...interface{}) Notifier {
+	return m.onFunc(1, 1, func(context.Context) { close(ch) }, ctx)
+}
+
+// SecondSignal closes ch in the second stage of the shutdown.
+// See FirstSignal.
+func (m *Manager) SecondSignal(ch chan<- struct{}, ctx ...interface{}) Notifier {
+	return m.onFunc(2, 1, func(context.Context) { close(ch) }, ctx)
+}
+
+// ThirdSignal closes ch in the third stage of the shutdown.
+// See FirstSignal.
+func (m *Manager) ThirdSignal(ch chan<- struct{}, ctx ...interface{}) Notifier {
+	return m.onFunc(3, 1, func(context.Context) { close(ch) }, ctx)
+}
+
+// condFn returns a function notifier function that calls fn if cond returns true.
+func condFn(cond func() bool, fn func()) func(context.Context) {
+	return func(context.Context) {
+		if cond() {
+			fn()
+		}
+	}
+}
+
+// PreShutdownCtxFn is like PreShutdownFn, but the function is given a context
+// that is cancelled when the timeout of the stage has expired.
+// The function should return when the context is cancelled.
+// If it doesn't, the shutdown will still continue and the function will keep running in the background.
+func (m *Manager) PreShutdownCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return m.onFunc(0, 1, fn, ctx)
+}
+
+// FirstCtxFn is like FirstFn, but the function is given a context
+// that is cancelled when the timeout of the stage has expired.
+// The function should return when the context is cancelled.
+// If it doesn't, the shutdown will still continue and the function will keep running in the background.
+func (m *Manager) FirstCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return m.onFunc(1, 1, fn, ctx)
+}
+
+// SecondCtxFn is like SecondFn, but the function is given a context
+// that is cancelled when the timeout of the stage has expired.
+// The function should return when the context is cancelled.
+// If it doesn't, the shutdown will still continue and the function will keep running in the background.
+func (m *Manager) SecondCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
+	return m.onFunc(2, 1, fn, ctx)
+}
+
+// ThirdCtxFn is like ThirdFn, but the function is given a context
+// that is cancelled when the timeout of the stage has expired.
+// The function should return when the context is cancelled.
+// If it doesn't, the shutdown will still continue and the function will keep running in the background.
+func (m *Manager) ThirdCtxFn(fn func(ctx context.Context), ctx ...interface{}) Notifier {
 	return m.onFunc(3, 1, fn, ctx)
 }
 
+// NumStages returns the number of shutdown stages, including the pre shutdown stage.
+func (m *Manager) NumStages() int {
+	return len(m.shutdownQueue)
+}
+
+// StageByIndex returns the stage with index i, where 0 is the pre shutdown stage.
+// If i is out of range false is returned.
+func (m *Manager) StageByIndex(i int) (Stage, bool) {
+	if i < 0 || i >= m.NumStages() {
+		return Stage{}, false
+	}
+	return Stage{n: i}, true
+}
+
+// CancelAll cancels all notifiers that have been registered, like calling Cancel on each of them.
+// Notifiers in stages that have already started are not affected.
+// Functions registered with for instance FirstFn are not called.
+// If shutdown is running, notifiers returned by for instance First are still notified, and like Cancel,
+// a goroutine closes each notification, so the stages do not wait for them.
+// The manager can still be used, and new notifiers can be registered for a later shutdown.
+func (m *Manager) CancelAll() {
+	m.srM.RLock()
+	running := m.shutdownRequested.Load()
+	m.srM.RUnlock()
+	m.sqM.Lock()
+	defer m.sqM.Unlock()
+	for stage := m.currentStage.n + 1; stage < len(m.shutdownQueue); stage++ {
+		internal := make(map[chan chan struct{}]bool, len(m.shutdownFnQueue[stage]))
+		for _, fn := range m.shutdownFnQueue[stage] {
+			// Cancel, so the goroutine exits.
+			internal[fn.internal.n.c] = true
+			close(fn.cancel)
+		}
+		var kept []iNotifier
+		for _, n := range m.shutdownQueue[stage] {
+			if running && !internal[n.n.c] {
+				go n.n.closeNotification(m.stageDone[stage])
+				kept = append(kept, n)
+				continue
+			}
+			delete(m.progress, n.n.c)
+		}
+		m.shutdownQueue[stage] = kept
+		m.shutdownFnQueue[stage] = nil
+	}
+}
+
 // OnSignal will start the shutdown when any of the given signals arrive
 //
 // A good shutdown default is
@@ -156,257 +530,1038 @@ func (m *Manager) OnSignal(exitCode int, sig ...os.Signal) {
 	signal.Notify(c, sig...)
 	go func() {
 		defer signal.Stop(c)
-		select {
-		case <-m.shutdownRequestedCh:
-			return
-		case <-c:
-			m.Shutdown()
-			if m.performOSExit {
-				os.Exit(exitCode)
+		for {
+			m.sqM.Lock()
+			aborted := m.abortedCh
+			m.sqM.Unlock()
+			select {
+			case <-m.StartedCh():
+				// Keep listening if the shutdown is aborted.
+				select {
+				case <-m.shutdownFinished:
+					return
+				case <-aborted:
+				}
+			case s := <-c:
+				if m.shutdown("signal: "+s.String(), m.secondShutdown) {
+					continue
+				}
+				if m.performOSExit {
+					os.Exit(exitCode)
+				}
+				return
 			}
 		}
 	}()
 }
 
+// SecondShutdownMode controls what happens when Shutdown is called
+// while a shutdown is already running. See WithSecondShutdown.
+type SecondShutdownMode int
+
+const (
+	// SecondShutdownWait makes the call wait until the running shutdown has finished,
+	// like Wait. This is the default, since a second call has always waited
+	// for the running shutdown, so existing callers keep working unchanged.
+	SecondShutdownWait SecondShutdownMode = iota
+
+	// SecondShutdownIgnore makes the call return at once.
+	SecondShutdownIgnore
+
+	// SecondShutdownExit makes the call wait until the running shutdown has finished,
+	// and then call os.Exit(1), if os.Exit is enabled. See WithOSExit.
+	SecondShutdownExit
+)
+
 // Shutdown will signal all notifiers in three stages.
 // It will first check that all locks have been released - see Lock()
-// This method is not safe to call concurrently, as a datarace for shutdownRequested is possible.
-// As shutdown is called
+// It is safe to call Shutdown concurrently. Only the first call runs the shutdown,
+// what the other calls do is controlled by WithSecondShutdown.
+// Calls made while the shutdown is running from a function called by the shutdown,
+// like functions registered with FirstFn, OnBeforeShutdown or WithOnStageComplete, return at once.
 func (m *Manager) Shutdown() {
-	m.srM.Lock()
+	m.shutdown("", m.secondShutdown)
+}
+
+// ShutdownWith is like Shutdown, but records why the shutdown was requested.
+// The reason is logged when shutdown starts, added to all events and given to
+// the function set with WithOnShutdownRequested. See also ShutdownReason.
+// If shutdown has already been requested, the reason is ignored.
+func (m *Manager) ShutdownWith(reason string) {
+	m.shutdown(reason, m.secondShutdown)
+}
+
+// ShutdownReason returns the reason given when the shutdown was requested.
+// If shutdown was started by OnSignal the reason contains the signal.
+// An empty string is returned if shutdown has not been requested or no reason was given.
+func (m *Manager) ShutdownReason() string {
+	r, _ := m.reason.Load().(string)
+	return r
+}
+
+// shutdown runs the shutdown, or waits for a running shutdown.
+// reason describes what requested the shutdown, and second controls
+// what the call does if a shutdown is already running.
+// Returns true if the shutdown was aborted or rejected.
+func (m *Manager) shutdown(reason string, second SecondShutdownMode) (aborted bool) {
+	if m.minUptimeReject {
+		if up := m.since(m.created); up < m.minUptime && !m.shutdownCalled.Load() {
+			m.log(Event{Level: LevelWarn, Context: reason, Message: fmt.Sprintf("Shutdown rejected, uptime %v is less than the minimum %v", up, m.minUptime)})
+			return true
+		}
+	}
+	m.sqM.Lock()
+	abortedCh := m.abortedCh
+	m.sqM.Unlock()
 	// if the current value is false, then store true. If we couldn't store true,
 	// then shutdown is already initalized
-	if !m.shutdownRequested.CompareAndSwap(false, true) {
-		m.srM.Unlock()
+	if !m.shutdownCalled.CompareAndSwap(false, true) {
+		select {
+		case <-m.shutdownFinished:
+			return false
+		default:
+		}
+		if second == SecondShutdownIgnore || m.inShutdown() {
+			return false
+		}
 		// Wait till shutdown finished
-		<-m.shutdownFinished
-		return
+		select {
+		case <-m.shutdownFinished:
+		case <-abortedCh:
+			return true
+		}
+		if second == SecondShutdownExit && m.performOSExit {
+			os.Exit(1)
+		}
+		return false
+	}
+	defer m.enterShutdown()()
+	if left := m.minUptime - m.since(m.created); left > 0 {
+		m.log(Event{Level: LevelWarn, Context: reason, Message: fmt.Sprintf("Delaying shutdown %v until the minimum uptime has passed", left)})
+		<-m.clock.After(left)
+	}
+	m.reason.Store(reason)
+	m.sqM.Lock()
+	if !m.forced.Load() {
+		m.kind.Store(int32(ShutdownGraceful))
 	}
+	m.sqM.Unlock()
+	m.observeShutdown()
+	if m.onShutdownRequested != nil {
+		m.onShutdownRequested(reason)
+	}
+	if m.hardDeadline > 0 {
+		m.srM.Lock()
+		m.setDeadline(m.clock.Now().Add(m.hardDeadline))
+		m.srM.Unlock()
+	}
+	m.runBeforeShutdown()
+
+	m.srM.Lock()
+	m.shutdownRequested.Store(true)
 	lwg := &m.wg
+	requested := m.shutdownRequestedCh
 	m.srM.Unlock()
 
-	close(m.shutdownRequestedCh)
+	close(requested)
 
 	// Add a pre-shutdown function that waits for all locks to be released.
-	m.PreShutdownFn(func() {
-		lwg.Wait()
-	})
+	waiter := m.PreShutdownCtxFn(func(ctx context.Context) {
+		done := make(chan struct{})
+		go func() {
+			lwg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}, "Waiting for locks")
 
 	m.sqM.Lock()
-	for stage := 0; stage < 4; stage++ {
-		m.srM.Lock()
-		m.currentStage = Stage{stage}
-		m.srM.Unlock()
+	m.lockWaiter = waiter
+	steps, stepped := m.steps, m.stepped
+	m.sqM.Unlock()
+	if stepped != nil {
+		defer func() { stepped <- false }()
+	}
+
+	// With PanicRepanic the panic is raised when shutdown has finished,
+	// so Wait and the other waiters are released first.
+	defer m.checkRepanic()
 
-		queue := m.shutdownQueue[stage]
-		if len(queue) == 0 {
+	started := m.clock.Now()
+	for stage := range m.shutdownQueue {
+		m.waitStep(steps, stepped, stage)
+		if m.abortIfRequested() {
+			return true
+		}
+		if m.deadlinePassed() {
+			m.kind.Store(int32(ShutdownForced))
+			m.skipStages(stage)
+			for _, c := range m.stageDone[stage:] {
+				close(c)
+			}
+			break
+		}
+		if m.skipped[stage] {
+			close(m.stageDone[stage])
 			continue
 		}
-
-		if stage == 0 {
-			m.logger.Printf("Initiating shutdown %v", time.Now())
-		} else {
-			m.logger.Printf("Shutdown stage %v", stage)
+		if m.forced.Load() && stage != m.forceStage.n {
+			m.cancelStage(stage)
+			close(m.stageDone[stage])
+			continue
 		}
-
-		wait := make([]chan struct{}, len(queue))
-		var calledFrom []string
-		if m.logLockTimeouts {
-			calledFrom = make([]string, len(queue))
+		m.drainLocksBefore(stage)
+		stageStart := m.clock.Now()
+		timedOut := m.runStage(stage)
+		close(m.stageDone[stage])
+		if m.onStageComplete != nil {
+			m.onStageComplete(Stage{n: stage}, m.since(stageStart), timedOut)
 		}
-		// Send notification to all waiting
-		for i, n := range queue {
-			wait[i] = make(chan struct{})
-			if m.logLockTimeouts {
-				calledFrom[i] = n.calledFrom
+		if m.repanicPending() {
+			// The remaining stages are not run.
+			for _, c := range m.stageDone[stage+1:] {
+				close(c)
 			}
-			queue[i].n.c <- wait[i]
+			break
 		}
+	}
+	m.sqM.Lock()
+	if m.abortRequested {
+		m.abort()
+		m.sqM.Unlock()
+		m.log(Event{Level: LevelWarn, Message: "Shutdown aborted"})
+		return true
+	}
+	m.sqM.Unlock()
+	total := m.since(started)
+	m.linger()
+	if m.summary {
+		m.logSummary(total)
+	}
+	if m.onShutdownComplete != nil {
+		m.onShutdownComplete(total)
+	}
+	if m.onComplete != nil {
+		m.onComplete(total, m.Err())
+	}
+	m.sqM.Lock()
+	close(m.shutdownFinished)
+	for _, c := range m.transitions {
+		close(c)
+	}
+	m.transitions = nil
+	m.sqM.Unlock()
+	m.checkRepanic()
+	if m.exitAfter && m.performOSExit {
+		os.Exit(m.exitAfterCode)
+	}
+	return false
+}
 
-		// Send notification to all function notifiers, but don't wait
-		for _, notifier := range m.shutdownFnQueue[stage] {
-			notifier.client.c <- make(chan struct{})
-			close(notifier.client.c)
-		}
+// linger waits for the exit linger after the last stage, see WithExitLinger.
+// It returns at once if shutdown is forced.
+func (m *Manager) linger() {
+	if m.exitLinger <= 0 {
+		return
+	}
+	m.sqM.Lock()
+	forced := m.forcedCh
+	m.sqM.Unlock()
+	m.srM.RLock()
+	d := m.capDeadline(m.exitLinger)
+	m.srM.RUnlock()
+	if d <= 0 {
+		return
+	}
+	t := m.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+	case <-forced:
+	}
+}
+
+// logSummary logs a single line summarizing the shutdown.
+func (m *Manager) logSummary(total time.Duration) {
+	m.sqM.Lock()
+	msg := fmt.Sprintf("Shutdown complete: %d stages, %d notifiers timed out, total %v", m.stagesRun, m.timedOutCount, total.Round(time.Millisecond))
+	m.sqM.Unlock()
+	reason := m.ShutdownReason()
+	if reason != "" {
+		msg += ", reason: " + reason
+	}
+	m.log(Event{Kind: EventShutdownCompleted, Context: reason, Message: msg, Duration: total})
+}
+
+// AbortShutdown will abort a shutdown in progress.
+// Shutdown can only be aborted if it has been enabled with WithAbortableUntil,
+// and the stage given there has not started.
+// The stage that is running will finish, but the following stages are not started.
+// When it has finished Started will return false, Lock will succeed again
+// and the manager can be shut down again. Notifiers in the stages that have run are removed,
+// since they cannot be notified again. The functions of WithOnShutdownComplete and
+// WithOnStageComplete are not called for stages that are not run.
+// Calls to Shutdown waiting for the shutdown will return.
+// Returns true if the shutdown will be aborted.
+func (m *Manager) AbortShutdown() bool {
+	m.sqM.Lock()
+	defer m.sqM.Unlock()
+	if !m.abortable || !m.shutdownCalled.Load() || m.currentStage.n >= m.abortableUntil.n {
+		return false
+	}
+	select {
+	case <-m.shutdownFinished:
+		return false
+	default:
+	}
+	m.abortRequested = true
+	return true
+}
 
-		// We don't lock while we are waiting for notifiers to return
+// abortIfRequested will abort the shutdown if it has been requested.
+// Returns true if the shutdown was aborted.
+func (m *Manager) abortIfRequested() bool {
+	m.sqM.Lock()
+	if !m.abortRequested {
 		m.sqM.Unlock()
+		return false
+	}
+	m.abort()
+	m.sqM.Unlock()
+	m.log(Event{Level: LevelWarn, Message: "Shutdown aborted"})
+	return true
+}
 
-		// Wait for all to return, no more than the shutdown delay
-		timeout := time.After(m.timeouts[stage])
+// abort resets the manager, so it can be shut down again.
+// The notifiers of the stages that have run are removed.
+// The caller must hold sqM.
+func (m *Manager) abort() {
+	m.srM.Lock()
+	defer m.srM.Unlock()
+	for s := 0; s <= m.currentStage.n; s++ {
+		for _, n := range m.shutdownQueue[s] {
+			delete(m.progress, n.n.c)
+		}
+		m.shutdownQueue[s] = nil
+		m.shutdownFnQueue[s] = nil
+		m.stageCtx[s] = nil
+	}
+	// If the pre shutdown stage has not run, the next shutdown adds a new waiter.
+	if m.lockWaiter.Valid() {
+		m.lockWaiter.remove()
+		m.lockWaiter = Notifier{}
+	}
+	for s := range m.stageDone {
+		select {
+		case <-m.stageDone[s]:
+			m.stageDone[s] = make(chan struct{})
+		default:
+		}
+	}
+	m.currentStage = Stage{-1}
+	m.stageDeadline = time.Time{}
+	m.deadline = time.Time{}
+	m.reason.Store("")
+	m.abortRequested = false
+	m.stagesRun, m.timedOutCount = 0, 0
+	if m.forced.Load() {
+		m.forcedCh = make(chan struct{})
+	}
+	m.forced.Store(false)
+	m.kind.Store(int32(ShutdownAborted))
+	m.shutdownRequestedCh = make(chan struct{})
+	m.shutdownRequested.Store(false)
+	close(m.abortedCh)
+	m.abortedCh = make(chan struct{})
+	m.shutdownCalled.Store(false)
+}
 
-	brwait:
-		for i := range wait {
-			var tick <-chan time.Time
-			if m.logLockTimeouts {
-				tick = time.NewTicker(m.statusTimer).C
-			}
-		wloop:
-			for {
-				select {
-				case <-wait[i]:
-					break wloop
-				case <-timeout:
-					if len(calledFrom) > 0 {
-						if m.onTimeOut != nil {
-							m.onTimeOut(Stage{n: stage}, calledFrom[i])
-						}
-						m.logger.Printf(m.errorPrefix+"Notifier Timed Out: %s", calledFrom[i])
-					}
-					m.logger.Printf(m.errorPrefix+"Timeout waiting to shutdown, forcing shutdown stage %v.", stage)
-					break brwait
-				case <-tick:
-					if len(calledFrom) > 0 {
-						m.logger.Printf(m.warningPrefix+"Stage %d, waiting for notifier (%s)", stage, calledFrom[i])
-					}
+// ShutdownWithDeadline will start the shutdown like Shutdown,
+// but ensure it has finished no later than t.
+// When t is reached the current stage times out and the remaining stages are skipped.
+// Notifiers in skipped stages are not notified, but are reported to the function set with WithOnTimeout.
+// If shutdown is already running, the deadline applies from the next stage.
+func (m *Manager) ShutdownWithDeadline(t time.Time) {
+	m.srM.Lock()
+	m.setDeadline(t)
+	m.srM.Unlock()
+	m.Shutdown()
+}
+
+// setDeadline sets the shutdown deadline to t, unless an earlier deadline has been set.
+// The caller must hold srM.
+func (m *Manager) setDeadline(t time.Time) {
+	if m.deadline.IsZero() || t.Before(m.deadline) {
+		m.deadline = t
+	}
+}
+
+// LocksHeld returns the number of locks that have been acquired with Lock
+// and have not been released or expired.
+func (m *Manager) LocksHeld() int {
+	return int(m.locksHeld.Load())
+}
+
+// drainLocksBefore waits for all held locks to be released before stage starts,
+// no longer than the time set with WithDrainLocksBefore.
+func (m *Manager) drainLocksBefore(stage int) {
+	m.srM.RLock()
+	d := m.drainLocks[stage]
+	if d <= 0 {
+		m.srM.RUnlock()
+		return
+	}
+	d = m.capDeadline(d)
+	lwg := &m.wg
+	m.srM.RUnlock()
+
+	done := make(chan struct{})
+	go func() {
+		lwg.Wait()
+		close(done)
+	}()
+	t := m.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C():
+		m.log(Event{Level: LevelWarn, Stage: Stage{stage}, Message: m.withReason(fmt.Sprintf("Timeout waiting for %d lock(s) to be released before stage %d", m.LocksHeld(), stage))})
+	}
+}
+
+// stageTimeout returns the timeout of stage, capped at the shutdown deadline.
+// If WithAdaptiveTimeout is used, the timeout is computed from the number of held locks.
+// The caller must hold srM.
+func (m *Manager) stageTimeout(stage int) time.Duration {
+	d := m.timeouts[stage]
+	if m.adaptivePerLock > 0 {
+		d = m.adaptiveBase + time.Duration(m.LocksHeld())*m.adaptivePerLock
+	}
+	return m.capDeadline(d)
+}
+
+// capDeadline returns d, or the time left until the deadline if that is shorter.
+// A zero d means no timeout, so the time left until the deadline is returned if one is set.
+// The caller must hold srM.
+func (m *Manager) capDeadline(d time.Duration) time.Duration {
+	if m.deadline.IsZero() {
+		return d
+	}
+	if left := m.deadline.Sub(m.clock.Now()); left < d || d == 0 {
+		return left
+	}
+	return d
+}
+
+// deadlinePassed returns true if a deadline has been set and has passed.
+func (m *Manager) deadlinePassed() bool {
+	m.srM.RLock()
+	defer m.srM.RUnlock()
+	return !m.deadline.IsZero() && !m.clock.Now().Before(m.deadline)
+}
+
+// OnBeforeShutdown adds a function that is called when Shutdown is called,
+// before shutdown is marked as started.
+// While the functions run Started will return false and Lock will keep succeeding,
+// so it can be used to deregister from service discovery before draining.
+// Functions are called in the order they were added.
+// If they have not returned within the pre shutdown timeout or the hard deadline, shutdown will continue.
+// Functions added after Shutdown has been called are ignored.
+func (m *Manager) OnBeforeShutdown(fn func()) {
+	m.sqM.Lock()
+	m.beforeShutdown = append(m.beforeShutdown, fn)
+	m.sqM.Unlock()
+}
+
+// callBeforeShutdown calls fns in order and closes done when they have returned.
+func (m *Manager) callBeforeShutdown(fns []func(), done chan struct{}) {
+	defer close(done)
+	defer m.enterShutdown()()
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					m.recovered(StagePS, "OnBeforeShutdown", nil, r, debug.Stack())
 				}
-			}
-		}
-		m.sqM.Lock()
+			}()
+			fn()
+		}()
 	}
-	close(m.shutdownFinished)
+}
+
+// runBeforeShutdown calls the functions added with OnBeforeShutdown
+// and waits for the pre drain delay.
+func (m *Manager) runBeforeShutdown() {
+	m.sqM.Lock()
+	fns := append([]func(){}, m.beforeShutdown...)
 	m.sqM.Unlock()
+
+	if len(fns) > 0 {
+		done := make(chan struct{})
+		go m.callBeforeShutdown(fns, done)
+		m.srM.RLock()
+		d := m.capDeadline(m.timeouts[0])
+		m.srM.RUnlock()
+		var timeout <-chan time.Time
+		if d != 0 {
+			timer := m.clock.NewTimer(d)
+			defer timer.Stop()
+			timeout = timer.C()
+		}
+		select {
+		case <-done:
+		case <-timeout:
+			m.log(Event{Level: LevelError, Stage: StagePS, Message: m.withReason("Timeout waiting for OnBeforeShutdown functions")})
+		}
+	}
+	if m.preDrainDelay > 0 {
+		m.srM.RLock()
+		d := m.capDeadline(m.preDrainDelay)
+		m.srM.RUnlock()
+		<-m.clock.After(d)
+	}
 }
 
 // Started returns true if shutdown has been started.
 // Note that shutdown can have been started before you check the value.
+// Started does not take any locks, so it can be used to short-circuit hot paths,
+// like middleware that is called for every request.
 func (m *Manager) Started() bool {
 	return m.shutdownRequested.Load()
 }
 
+// StageName returns the name of the stage, as set with WithStageNames.
+// Without names set, it is the same as s.String().
+func (m *Manager) StageName(s Stage) string {
+	if s.n < 0 || s.n >= len(m.stageNames) {
+		return s.String()
+	}
+	return m.stageNames[s.n]
+}
+
+// CurrentStage returns the stage currently being executed.
+// If shutdown hasn't started or has completed, false is returned.
+func (m *Manager) CurrentStage() (Stage, bool) {
+	select {
+	case <-m.shutdownFinished:
+		return Stage{}, false
+	default:
+	}
+	m.srM.RLock()
+	defer m.srM.RUnlock()
+	if !m.shutdownRequested.Load() {
+		return Stage{}, false
+	}
+	if m.currentStage.n < 0 {
+		// Shutdown has been requested, but the first stage hasn't started yet.
+		return StagePS, true
+	}
+	return m.currentStage, true
+}
+
+// StageDeadline returns the time when the current stage times out,
+// for instance to show a countdown together with CurrentStage.
+// If shutdown hasn't started, has completed, or the current stage has no timeout, false is returned.
+func (m *Manager) StageDeadline() (time.Time, bool) {
+	select {
+	case <-m.shutdownFinished:
+		return time.Time{}, false
+	default:
+	}
+	m.srM.RLock()
+	defer m.srM.RUnlock()
+	if !m.shutdownRequested.Load() || m.stageDeadline.IsZero() {
+		return time.Time{}, false
+	}
+	return m.stageDeadline, true
+}
+
 // StartedCh returns a channel that is closed once shutdown has started.
+// It can be used in a select by goroutines that only need to know that shutdown
+// has started, and will exit on their own without signalling back.
+// Repeated calls return the same channel.
+// If shutdown is aborted, a new channel is returned for the next shutdown.
 func (m *Manager) StartedCh() <-chan struct{} {
+	m.srM.RLock()
+	defer m.srM.RUnlock()
 	return m.shutdownRequestedCh
 }
 
+// Transitions returns a channel that receives each stage as it begins,
+// for a goroutine that follows the shutdown in a select loop.
+// Each call returns a new channel. The channel has room for all stages,
+// so a consumer that is behind does not miss stages of a shutdown, but if it
+// has not received the stages of an aborted shutdown when the next shutdown runs,
+// the stages that do not fit are dropped rather than delaying the shutdown.
+// Stages that are skipped are not sent. The channel is closed when shutdown has completed,
+// and if shutdown has already completed, a closed channel is returned.
+func (m *Manager) Transitions() <-chan Stage {
+	c := make(chan Stage, len(m.shutdownQueue))
+	m.sqM.Lock()
+	defer m.sqM.Unlock()
+	if m.finished() {
+		close(c)
+		return c
+	}
+	m.transitions = append(m.transitions, c)
+	return c
+}
+
 // Wait will wait until shutdown has finished.
 // This can be used to keep a main function from exiting
 // until shutdown has been called, either by a goroutine
 // or a signal.
+// If Wait is called from a function called by the shutdown of m, like a function registered
+// with FirstFn, it returns at once, since the shutdown cannot finish before the function has returned.
+// Calls from goroutines started by such a function are not detected.
+// Waiting for another manager from a shutdown function waits as usual.
 func (m *Manager) Wait() {
+	select {
+	case <-m.shutdownFinished:
+		return
+	default:
+	}
+	if m.inShutdown() {
+		return
+	}
 	<-m.shutdownFinished
 }
 
+// WaitTimeout will wait until shutdown has finished, but no longer than d.
+// Returns true if shutdown finished, false if the duration expired first.
+// A later call to Wait or WaitTimeout is not affected.
+func (m *Manager) WaitTimeout(d time.Duration) bool {
+	t := m.clock.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-m.shutdownFinished:
+		return true
+	case <-t.C():
+		return false
+	}
+}
+
+// WaitContext will wait until shutdown has finished or ctx is cancelled.
+// Returns nil if shutdown finished, otherwise the error of the context.
+// Any number of goroutines can wait at the same time.
+func (m *Manager) WaitContext(ctx context.Context) error {
+	select {
+	case <-m.shutdownFinished:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// StageDone returns true if stage s has finished.
+// A stage has finished when all its notifiers have finished or the stage has timed out.
+// False is returned for stages that haven't finished.
+func (m *Manager) StageDone(s Stage) bool {
+	if s.n < 0 || s.n >= len(m.stageDone) {
+		return false
+	}
+	select {
+	case <-m.stageDoneCh(s):
+		return true
+	default:
+		return false
+	}
+}
+
+// stageDoneCh returns the channel that is closed when stage s has finished.
+func (m *Manager) stageDoneCh(s Stage) chan struct{} {
+	m.sqM.Lock()
+	defer m.sqM.Unlock()
+	return m.stageDone[s.n]
+}
+
+// WaitStage will wait until stage s has finished.
+// If shutdown hasn't started, it waits until shutdown starts and the stage finishes.
+// It returns at once if s is not a valid stage.
+func (m *Manager) WaitStage(s Stage) {
+	_ = m.WaitStageContext(context.Background(), s)
+}
+
+// WaitStageContext is like WaitStage, but returns the error of ctx
+// if it is cancelled before the stage has finished.
+func (m *Manager) WaitStageContext(ctx context.Context, s Stage) error {
+	if s.n < 0 || s.n >= len(m.stageDone) {
+		return nil
+	}
+	select {
+	case <-m.stageDoneCh(s):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // CompletedCh returns a channel that will be closed when shutdown has completed
 func (m *Manager) CompletedCh() <-chan struct{} {
 	return m.shutdownFinished
 }
 
+// SetTimeout sets maximum delay to wait for each stage to finish.
+// If shutdown has started, only stages that have not started yet are affected.
+// A zero timeout means that the stages have no timeout, see WithTimeout.
+// A negative timeout is logged and treated as zero.
+func (m *Manager) SetTimeout(d time.Duration) {
+	d = m.validTimeout(d)
+	m.srM.Lock()
+	defer m.srM.Unlock()
+	m.timeout = d
+	for i := range m.timeouts {
+		if m.stageStarted(i) {
+			continue
+		}
+		m.timeouts[i] = d
+	}
+}
+
+// SetTimeoutN set maximum delay to wait for a specific stage to finish.
+// If the stage has already started, this has no effect.
+// A zero timeout means that the stage has no timeout, and a negative timeout
+// is logged and treated as zero.
+func (m *Manager) SetTimeoutN(s Stage, d time.Duration) {
+	d = m.validTimeout(d)
+	m.srM.Lock()
+	defer m.srM.Unlock()
+	if m.stageStarted(s.n) {
+		return
+	}
+	m.timeouts[s.n] = d
+}
+
+// validTimeout returns d, or zero with a logged warning if d is negative.
+func (m *Manager) validTimeout(d time.Duration) time.Duration {
+	if d < 0 {
+		m.log(Event{Level: LevelWarn, Message: fmt.Sprintf("Negative timeout %v, using no timeout", d)})
+		return 0
+	}
+	return d
+}
+
+// checkTimeouts replaces negative timeouts set by options with zero.
+// WithTimeout also sets the timeout of every stage, so stages with that timeout
+// are not warned about again.
+func (m *Manager) checkTimeouts() {
+	all := m.timeout
+	m.timeout = m.validTimeout(m.timeout)
+	for i, d := range m.timeouts {
+		if d < 0 && d == all {
+			m.timeouts[i] = 0
+			continue
+		}
+		m.timeouts[i] = m.validTimeout(d)
+	}
+	m.bestEffortTimeout = m.validTimeout(m.bestEffortTimeout)
+}
+
+// Timeout returns the timeout last set for all stages with WithTimeout or SetTimeout.
+// Use TimeoutN to get the timeout of a specific stage.
+func (m *Manager) Timeout() time.Duration {
+	m.srM.RLock()
+	defer m.srM.RUnlock()
+	return m.timeout
+}
+
+// TimeoutN returns the timeout of a specific stage.
+func (m *Manager) TimeoutN(s Stage) time.Duration {
+	m.srM.RLock()
+	defer m.srM.RUnlock()
+	return m.timeouts[s.n]
+}
+
+// stageStarted returns true if shutdown has reached the stage.
+// The caller must hold srM.
+func (m *Manager) stageStarted(stage int) bool {
+	return m.shutdownRequested.Load() && stage <= m.currentStage.n
+}
+
 // Lock will signal that you have a function running,
 // that you do not want to be interrupted by a shutdown.
 //
 // The lock is created with a timeout equal to the length of the
-// preshutdown stage at the time of creation. When that amount of
-// time has expired the lock will be removed, and a warning will
-// be printed.
+// preshutdown stage at the time of creation, or the lease set with
+// WithLockLeaseTimeout. When that amount of time has expired the lock
+// will be removed, and a warning will be printed.
 //
 // If the function returns nil shutdown has already been initiated,
 // and you did not get a lock. You should therefore not call the returned
 // function.
 //
 // If the function did not return nil, you should call the function to unlock
-// the lock.
+// the lock. Calling it more than once, or after the lock has expired, has no effect.
 //
 // You should not hold a lock when you start a shutdown.
 //
 // For easier debugging you can send a context that will be printed if the lock
 // times out. All supplied context is printed with '%v' formatting.
 func (m *Manager) Lock(ctx ...interface{}) func() {
+	unlock, _ := m.lock(1, ctx)
+	return unlock
+}
+
+// TryLock is like Lock, but returns ErrShuttingDown if shutdown has been initiated,
+// so callers can branch on the error with errors.Is, for instance in middleware
+// that maps errors to status codes.
+// If the error is nil, you should call the returned function to unlock the lock.
+func (m *Manager) TryLock(ctx ...interface{}) (unlock func(), err error) {
+	return m.lock(1, ctx)
+}
+
+// lock acquires a lock.
+// depth is the call depth of the caller.
+func (m *Manager) lock(depth int, ctx []interface{}) (func(), error) {
 	m.srM.RLock()
 	if m.shutdownRequested.Load() {
 		m.srM.RUnlock()
-		return nil
+		return nil, ErrShuttingDown
 	}
 	m.wg.Add(1)
+	m.observeLock(int(m.locksHeld.Add(1)))
+	lease := m.timeouts[0]
+	if m.lockLease > 0 {
+		lease = m.lockLease
+	}
+	var timeout <-chan time.Time
+	if lease > 0 {
+		timeout = m.clock.After(lease)
+	}
 	m.srM.RUnlock()
 
 	var release = make(chan struct{})
-	var timeout = time.After(m.timeouts[0])
+	var start = m.clock.Now()
 
 	// Store what called this
 	var calledFrom string
-	if m.logLockTimeouts {
-		_, file, line, _ := runtime.Caller(1)
+	tracked := m.logLockTimeouts && m.lockTracking
+	if tracked {
+		_, file, line, _ := runtime.Caller(depth + 1)
 		if len(ctx) > 0 {
 			calledFrom = fmt.Sprintf("%v. ", ctx)
 		}
 		calledFrom = fmt.Sprintf("%sCalled from %s:%d", calledFrom, file, line)
+		m.lockM.Lock()
+		if m.locks == nil {
+			m.locks = make(map[chan struct{}]heldLock)
+		}
+		m.locks[release] = heldLock{calledFrom: calledFrom, start: start}
+		m.lockM.Unlock()
+	} else if m.logLockTimeouts && len(ctx) > 0 {
+		calledFrom = fmt.Sprintf("%v", ctx)
 	}
 
 	go func(wg *sync.WaitGroup) {
 		defer wg.Done()
+		defer m.locksHeld.Add(-1)
+		if tracked {
+			defer func() {
+				m.lockM.Lock()
+				delete(m.locks, release)
+				m.lockM.Unlock()
+			}()
+		}
 		select {
 		case <-timeout:
 			if m.onTimeOut != nil {
-				m.onTimeOut(StagePS, calledFrom)
+				m.onTimeOut(StagePS, calledFrom, m.since(start), m.ShutdownReason())
 			}
 			if m.logLockTimeouts {
-				m.logger.Printf(m.warningPrefix+"Lock expired! %s", calledFrom)
+				m.log(Event{Kind: EventLockExpired, Level: LevelWarn, Stage: StagePS, Context: calledFrom, Message: m.withReason("Lock expired"), Duration: m.since(start)})
 			}
 		case <-release:
 		}
 	}(&m.wg)
-	return func() { close(release) }
+	var once sync.Once
+	return func() { once.Do(func() { close(release) }) }, nil
+}
+
+// locksTimedOut reports the callers of all locks that have not been released
+// when the pre shutdown stage times out.
+func (m *Manager) locksTimedOut() {
+	for _, l := range m.heldLocks() {
+		if m.onTimeOut != nil {
+			m.onTimeOut(StagePS, l.calledFrom, m.since(l.start), m.ShutdownReason())
+		}
+		m.log(Event{Kind: EventLockExpired, Level: LevelError, Stage: StagePS, Context: l.calledFrom, Message: m.withReason("Lock not released before pre shutdown timeout"), Duration: m.since(l.start)})
+	}
+}
+
+// heldLocks returns the tracked locks that have not been released, sorted by caller.
+func (m *Manager) heldLocks() []heldLock {
+	m.lockM.Lock()
+	held := make([]heldLock, 0, len(m.locks))
+	for _, l := range m.locks {
+		held = append(held, l)
+	}
+	m.lockM.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i].calledFrom < held[j].calledFrom })
+	return held
+}
+
+// heldLock is a lock that has not been released.
+type heldLock struct {
+	calledFrom string
+	start      time.Time
 }
 
 // Create a function notifier.
 // depth is the call depth of the caller.
-func (m *Manager) onFunc(prio, depth int, fn func(), ctx []interface{}) Notifier {
-	f := fnNotify{
-		internal: m.onShutdown(prio, depth+1, ctx),
-		cancel:   make(chan struct{}),
-		client:   m.newNotifier(),
+func (m *Manager) onFunc(prio, depth int, fn func(context.Context), ctx []interface{}) Notifier {
+	return m.onFuncCancel(prio, depth+1, fn, nil, ctx)
+}
+
+// onFuncCancel is like onFunc, but cancelled is called if the notifier
+// is cancelled before it has been notified.
+func (m *Manager) onFuncCancel(prio, depth int, fn func(context.Context), cancelled func(), ctx []interface{}) Notifier {
+	f := &fnNotify{
+		cancel:    make(chan struct{}),
+		cancelled: cancelled,
+		client:    m.newNotifier(),
 	}
-	if f.internal.n.c == nil {
+	if in := m.register(prio, depth+1, ctx, f); in.n.c == nil {
 		return Notifier{}
 	}
-	go func() {
-		select {
-		case <-f.cancel:
-			return
-		case c := <-f.internal.n.c:
-			{
-				defer func() {
-					if r := recover(); r != nil {
-						m.logger.Printf(m.errorPrefix+"Panic in shutdown function: %v (%v)", r, f.internal.calledFrom)
-						m.logger.Printf("%s", string(debug.Stack()))
-					}
-					if c != nil {
-						close(c)
-					}
-				}()
-				fn()
-			}
-		}
-	}()
-	m.sqM.Lock()
-	m.shutdownFnQueue[prio] = append(m.shutdownFnQueue[prio], f)
-	m.sqM.Unlock()
+	go m.callFn(prio, f, fn)
 	return f.client
 }
 
+// callFn waits for the notification of the function notifier f and calls fn.
+// It returns if the notifier is cancelled.
+func (m *Manager) callFn(prio int, f *fnNotify, fn func(context.Context)) {
+	select {
+	case <-f.cancel:
+		if f.cancelled != nil {
+			f.cancelled()
+		}
+		return
+	case c := <-f.internal.n.c:
+		m.sqM.Lock()
+		sctx := m.stageCtx[prio]
+		m.sqM.Unlock()
+		if f.internal.bestEffort {
+			ctx, cancel := m.timeoutContext(sctx, m.bestEffortTimeout)
+			defer cancel()
+			sctx = ctx
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				m.recovered(Stage{prio}, f.internal.calledFrom, f.internal.labels, r, debug.Stack())
+			}
+			if c != nil {
+				close(c)
+			}
+		}()
+		defer m.enterShutdown()()
+		fn(sctx)
+	}
+}
+
 // onShutdown will request a shutdown notifier.
 // depth is the call depth of the caller.
 func (m *Manager) onShutdown(prio, depth int, ctx []interface{}) iNotifier {
+	return m.register(prio, depth+1, ctx, nil)
+}
+
+// register adds a notifier to the queue of stage prio.
+// If f is not nil, f is queued as a function notifier, with the notifier as internal notifier.
+// Both are queued under the same lock, so a stage that starts concurrently
+// either sees both or neither.
+// depth is the call depth of the caller.
+func (m *Manager) register(prio, depth int, ctx []interface{}, f *fnNotify) iNotifier {
 	m.sqM.Lock()
-	if m.currentStage.n >= prio {
+	if m.currentStage.n >= prio || m.finished() || m.skipped[prio] {
 		m.sqM.Unlock()
 		return iNotifier{n: Notifier{}}
 	}
 	n := m.newNotifier()
+	var site string
+	if m.logLockTimeouts || m.lockTracking {
+		_, file, line, _ := runtime.Caller(depth + 1)
+		site = fmt.Sprintf("%s:%d", file, line)
+	}
+	if m.lockTracking {
+		n.site = site
+	}
 	in := iNotifier{n: n}
+	ctx = in.apply(ctx)
 	if m.logLockTimeouts {
-		_, file, line, _ := runtime.Caller(depth + 1)
-		in.calledFrom = fmt.Sprintf("%s:%d", file, line)
+		in.calledFrom = site
 		if len(ctx) != 0 {
 			in.calledFrom = fmt.Sprintf("%v - %s", ctx, in.calledFrom)
 		}
+		if in.labels != nil && len(*in.labels) != 0 {
+			in.calledFrom = fmt.Sprintf("%s - %s", formatLabels(*in.labels), in.calledFrom)
+		}
+	}
+	if !m.resolveDeps(prio, &in) {
+		m.sqM.Unlock()
+		m.log(Event{Level: LevelError, Stage: Stage{prio}, Context: in.calledFrom, labels: in.labels, Message: "Notifier depends on a notifier that cannot finish before it, not registered"})
+		return iNotifier{n: Notifier{}}
 	}
 	m.shutdownQueue[prio] = append(m.shutdownQueue[prio], in)
+	if f != nil {
+		f.internal = in
+		f.client.site = n.site
+		m.shutdownFnQueue[prio] = append(m.shutdownFnQueue[prio], *f)
+	}
 	m.sqM.Unlock()
 	return in
 }
 
+// resolveDeps finds the queued notifiers that in depends on, and stores them in in.deps.
+// Function notifiers are resolved to their internal notifier.
+// Invalid dependencies, like the notifiers of stages that have started, are skipped.
+// It returns false if a dependency runs after in, or belongs to another manager.
+// The caller must hold sqM.
+func (m *Manager) resolveDeps(prio int, in *iNotifier) bool {
+	for _, d := range in.dependsOn {
+		if !d.Valid() {
+			continue
+		}
+		if d.m != m {
+			return false
+		}
+		for s := range m.shutdownQueue {
+			var deps []iNotifier
+			for _, q := range m.shutdownQueue[s] {
+				if q.n.c == d.c {
+					deps = append(deps, q)
+				}
+			}
+			for _, fn := range m.shutdownFnQueue[s] {
+				if fn.client.c == d.c {
+					deps = append(deps, fn.internal)
+				}
+			}
+			for _, dep := range deps {
+				if s > prio || (s == prio && dep.priority > in.priority) {
+					return false
+				}
+				in.deps = append(in.deps, dep.n.c)
+			}
+		}
+	}
+	in.dependsOn = nil
+	return true
+}
+
+// finished returns true if shutdown has finished.
+// Stages may have been skipped, so currentStage is not enough to tell.
+// The caller must hold sqM.
+func (m *Manager) finished() bool {
+	select {
+	case <-m.shutdownFinished:
+		return true
+	default:
+		return false
+	}
+}
+
 // newNotifier returns a new notifier linked to the manager
 func (m *Manager) newNotifier() Notifier {
 	return Notifier{c: make(chan chan struct{}, 1), m: m}
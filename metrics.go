@@ -0,0 +1,100 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import "time"
+
+// Metrics is a snapshot of the counters of a manager, see Manager.Metrics.
+type Metrics struct {
+	// Shutdowns is the number of shutdowns started, including aborted shutdowns.
+	Shutdowns int
+
+	// StageTimeouts is the number of stages that have timed out,
+	// or have been skipped because the hard deadline was reached.
+	StageTimeouts int
+
+	// Panics is the number of panics recovered in shutdown functions.
+	Panics int
+
+	// StageDurations are the durations of the stages in the latest shutdown,
+	// indexed by the stage index. Stages without notifiers are 0.
+	StageDurations [4]time.Duration
+
+	// LockAcquisitions is the number of locks acquired.
+	LockAcquisitions int64
+
+	// MaxLocks is the highest number of locks held at the same time.
+	MaxLocks int
+}
+
+// Metrics returns a snapshot of the counters of the manager,
+// so they can be exported to any metrics system.
+// It is safe to call at any time, also during and after shutdown.
+func (m *Manager) Metrics() Metrics {
+	m.metricsM.Lock()
+	defer m.metricsM.Unlock()
+	return m.metrics
+}
+
+// LastRunWithinBudget returns true if the latest shutdown has completed
+// without any stage timing out, so a test can fail when cleanup gets slow.
+// Stages skipped because the hard deadline was reached, and stages that kept
+// waiting after their timeout with KeepWaiting, count as timed out, while
+// notifiers registered with BestEffort do not. See Metrics for the details.
+// If shutdown has not completed, false is returned.
+func (m *Manager) LastRunWithinBudget() bool {
+	select {
+	case <-m.shutdownFinished:
+	default:
+		return false
+	}
+	m.metricsM.Lock()
+	defer m.metricsM.Unlock()
+	return m.stageTimedOuts == [4]bool{}
+}
+
+// observe updates the metrics from an event.
+func (m *Manager) observe(e Event) {
+	switch e.Kind {
+	case EventStageTimeout:
+		m.metricsM.Lock()
+		m.metrics.StageTimeouts++
+		m.stageTimedOuts[e.Stage.n] = true
+		m.metricsM.Unlock()
+	case EventNotifierTimeout:
+		if e.Level == LevelInfo {
+			// Best effort notifiers do not count.
+			return
+		}
+		m.metricsM.Lock()
+		m.stageTimedOuts[e.Stage.n] = true
+		m.metricsM.Unlock()
+	case EventPanic:
+		m.metricsM.Lock()
+		m.metrics.Panics++
+		m.metricsM.Unlock()
+	case EventStageCompleted:
+		m.metricsM.Lock()
+		m.metrics.StageDurations[e.Stage.n] = e.Duration
+		m.metricsM.Unlock()
+	}
+}
+
+// observeShutdown counts a shutdown and resets the stage durations and timeouts.
+func (m *Manager) observeShutdown() {
+	m.metricsM.Lock()
+	m.metrics.Shutdowns++
+	m.metrics.StageDurations = [4]time.Duration{}
+	m.stageTimedOuts = [4]bool{}
+	m.metricsM.Unlock()
+}
+
+// observeLock counts a lock, when held locks are held.
+func (m *Manager) observeLock(held int) {
+	m.metricsM.Lock()
+	m.metrics.LockAcquisitions++
+	if held > m.metrics.MaxLocks {
+		m.metrics.MaxLocks = held
+	}
+	m.metricsM.Unlock()
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage2, 20*time.Millisecond), WithLogPrinter(t.Logf))
+	defer close(startTimer(m, t))
+
+	unlocks := make([]func(), 3)
+	for i := range unlocks {
+		unlocks[i] = m.Lock()
+	}
+	for _, unlock := range unlocks {
+		unlock()
+	}
+	m.Lock()()
+
+	_ = m.FirstFn(func() { time.Sleep(10 * time.Millisecond) })
+	_ = m.FirstFn(func() { panic("metrics") })
+	stuck := m.Second()
+	var during Metrics
+	_ = m.ThirdFn(func() { during = m.Metrics() })
+	m.Shutdown()
+	close(<-stuck.Notify())
+
+	got := m.Metrics()
+	if got.Shutdowns != 1 || got.StageTimeouts != 1 || got.Panics != 1 {
+		t.Errorf("want 1 shutdown, timeout and panic, got %+v", got)
+	}
+	// Locks are released in the background, so more than 3 may be counted.
+	if got.LockAcquisitions != 4 || got.MaxLocks < 3 {
+		t.Errorf("want 4 locks acquired and at least 3 at most, got %+v", got)
+	}
+	if got.StageDurations[1] < 10*time.Millisecond || got.StageDurations[2] < 20*time.Millisecond {
+		t.Errorf("unexpected stage durations %v", got.StageDurations)
+	}
+	if during.StageDurations[3] != 0 || during.StageDurations[2] == 0 {
+		t.Errorf("want stage 2 but not stage 3 completed during stage 3, got %v", during.StageDurations)
+	}
+}
+
+func TestLastRunWithinBudget(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	m.FirstFn(func() {})
+	if m.LastRunWithinBudget() {
+		t.Fatal("within budget before shutdown")
+	}
+	m.Shutdown()
+	if !m.LastRunWithinBudget() {
+		t.Error("want shutdown within budget")
+	}
+
+	m = New(WithTimeout(time.Second), WithTimeoutN(Stage2, 20*time.Millisecond), WithLogger(nil))
+	defer close(startTimer(m, t))
+	m.Second("stuck")
+	m.Shutdown()
+	if m.LastRunWithinBudget() {
+		t.Error("want shutdown over budget when a stage timed out")
+	}
+}
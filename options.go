@@ -1,9 +1,88 @@
 package shutdown
 
-import "time"
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+)
 
 type Option func(*Manager)
 
+// NotifierOption is an option for a single notifier.
+// Notifier options are supplied together with the context when registering a notifier,
+// for instance m.FirstFn(fn, "context", WithPriority(10)).
+// They are not included in the logged context.
+type NotifierOption func(*iNotifier)
+
+// WithPriority sets the priority of a notifier within its stage.
+// Notifiers with a lower priority are notified and must finish before notifiers with a higher
+// priority are notified. Notifiers with the same priority are notified at once.
+// The default priority is 0.
+func WithPriority(p int) NotifierOption {
+	return func(in *iNotifier) {
+		in.priority = p
+	}
+}
+
+// BestEffort marks a notifier as best effort, for cleanup that is nice to have,
+// like flushing a cache. The stage waits for it no longer than its own timeout,
+// set with WithBestEffortTimeout, and the context given to its function is cancelled then.
+// If it times out, it is logged at info level and does not count as a timeout:
+// the function set with WithOnTimeout is not called, and it is not included in
+// the summary or Metrics. The stage waits for the other notifiers first.
+func BestEffort() NotifierOption {
+	return func(in *iNotifier) {
+		in.bestEffort = true
+	}
+}
+
+// DependsOn makes the notifier wait for the notifiers in ns to finish before it is notified,
+// even if they are in the same stage and have the same priority.
+// Notifiers in an earlier stage have always finished, or timed out, when a stage starts.
+// Since a notifier can only depend on notifiers that exist, dependencies cannot form a cycle
+// by themselves. A dependency on a notifier that runs later, in a later stage or with a higher
+// priority in the same stage, would never be satisfied. The notifier is then not registered,
+// an error is logged, and an invalid notifier is returned.
+// The same applies to a dependency on a notifier of another manager.
+// Dependencies that have been cancelled, and invalid notifiers, are ignored.
+func DependsOn(ns ...Notifier) NotifierOption {
+	return func(in *iNotifier) {
+		in.dependsOn = append(in.dependsOn, ns...)
+	}
+}
+
+// WithLabels attaches labels to the notifier, like the tenant or shard it serves,
+// to correlate a stuck notifier with what it is working on.
+// The labels are returned by Event.Labels for the events about the notifier, and if lock timeout
+// logging is enabled, they are added to the context of the notifier, as "{key=value,...}",
+// which is also given to the function set with WithOnTimeout and written by DumpPlan.
+// The map is copied. Labels given by more than one WithLabels are merged.
+func WithLabels(labels map[string]string) NotifierOption {
+	return func(in *iNotifier) {
+		if in.labels == nil {
+			l := make(map[string]string, len(labels))
+			in.labels = &l
+		}
+		for k, v := range labels {
+			(*in.labels)[k] = v
+		}
+	}
+}
+
+// apply applies the notifier options in ctx and returns the remaining context.
+func (in *iNotifier) apply(ctx []interface{}) []interface{} {
+	var rest []interface{}
+	for _, c := range ctx {
+		if opt, ok := c.(NotifierOption); ok {
+			opt(in)
+			continue
+		}
+		rest = append(rest, c)
+	}
+	return rest
+}
+
 // WithOSExit toggles calling os.Exit.
 func WithOSExit(b bool) Option {
 	return func(m *Manager) {
@@ -11,10 +90,78 @@ func WithOSExit(b bool) Option {
 	}
 }
 
-// WithLogPrinter sets the logprinter
+// WithMinUptime sets the minimum time from the manager is created until shutdown can start,
+// to avoid thrashing when a process is restarted rapidly.
+// If Shutdown is called earlier, the shutdown is delayed until d has passed,
+// or rejected and ignored if reject is true. A signal received by OnSignal that is rejected
+// does not exit the process, and the next signal will be handled.
+// Calls to Shutdown made while a shutdown is delayed are handled as second calls,
+// so with SecondShutdownExit they exit when the delayed shutdown has finished.
+func WithMinUptime(d time.Duration, reject bool) Option {
+	return func(m *Manager) {
+		m.minUptime = d
+		m.minUptimeReject = reject
+	}
+}
+
+// WithSecondShutdown sets what Shutdown does when it is called while a shutdown is already running,
+// for instance when a signal handler calls Shutdown repeatedly.
+// The default is SecondShutdownWait, where the call waits for the running shutdown to finish,
+// as calls did before the mode could be set.
+// Calls made after the shutdown has finished always return at once.
+func WithSecondShutdown(mode SecondShutdownMode) Option {
+	return func(m *Manager) {
+		m.secondShutdown = mode
+	}
+}
+
+// WithLogPrinter sets the logprinter.
+// Events are formatted as a single line and prefixed with the warning or error prefix.
 func WithLogPrinter(fn func(format string, v ...interface{})) Option {
+	return loggerOption(func(m *Manager) func(Event) {
+		return m.printer(logWrapper{w: fn})
+	})
+}
+
+// WithLogPrinterV2 is like WithLogPrinter, but the stage and elapsed time of each event
+// are also given to fn, so they can be used for prefixes or filtering.
+// The elapsed time is the time of the stage or lock, if relevant for the event, otherwise 0.
+func WithLogPrinterV2(fn func(s Stage, elapsed time.Duration, format string, v ...interface{})) Option {
+	return loggerOption(func(m *Manager) func(Event) {
+		return m.printerV2(fn)
+	})
+}
+
+// WithLogger sets a function that receives all events as structured values.
+// This replaces the log printer.
+// A nil function will disable logging.
+func WithLogger(fn func(e Event)) Option {
+	if fn == nil {
+		fn = func(Event) {}
+	}
+	return loggerOption(func(*Manager) func(Event) {
+		return fn
+	})
+}
+
+// WithEventHook adds a function that receives all events.
+// Unlike WithLogger it does not replace the logger, so it can be used
+// to feed metrics from the events. Several hooks can be added.
+func WithEventHook(fn func(e Event)) Option {
 	return func(m *Manager) {
-		m.logger = logWrapper{w: fn}
+		m.hooks = append(m.hooks, fn)
+	}
+}
+
+// WithEventBuffer keeps the n most recent events in memory, in addition to sending them
+// to the logger and hooks, so they can be read with RecentEvents.
+// If n is 0 or less no events are kept.
+func WithEventBuffer(n int) Option {
+	return func(m *Manager) {
+		m.recent = nil
+		if n > 0 {
+			m.recent = newEventRing(n)
+		}
 	}
 }
 
@@ -25,18 +172,272 @@ func WithLogLockTimeouts(logTimeouts bool) Option {
 	}
 }
 
+// WithUnavailableStatus sets the HTTP status code returned by WrapHandler, WrapHandlerFunc,
+// WrapHandlerNamed and WrapHandlerDrain for requests that are rejected because of shutdown.
+// The code must be an error status between 400 and 599, otherwise a warning is logged
+// and the default, http.StatusServiceUnavailable, is used.
+func WithUnavailableStatus(code int) Option {
+	return func(m *Manager) {
+		m.unavailableStatus = code
+	}
+}
+
+// WithLockLeaseTimeout sets the maximum time a lock can be held.
+// A lock held longer than d is released automatically, so a lock that is never
+// unlocked cannot block the pre shutdown stage. The lock is logged as expired,
+// with its caller if lock tracking is enabled, and reported to the function set with WithOnTimeout.
+// By default locks expire after the timeout of the pre shutdown stage.
+func WithLockLeaseTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.lockLease = d
+	}
+}
+
+// WithLockTracking toggles recording the caller of each lock. Default: true
+// Recording the caller has a cost on every call to Lock, so it can be disabled on hot paths.
+// When disabled, lock timeouts are still logged and reported, but without the caller.
+func WithLockTracking(b bool) Option {
+	return func(m *Manager) {
+		m.lockTracking = b
+	}
+}
+
 // WithOnTimeout allows you to get a notification if a shutdown stage times out.
 // The stage and the context of the hanging shutdown/lock function is returned.
+// If the pre shutdown stage times out, it is called for each lock that has not been released,
+// with the caller of Lock as context. Lock callers are only recorded if WithLogLockTimeouts
+// and WithLockTracking are enabled.
+// Use WithOnTimeoutV2 to also get how long the notifier or lock has been running,
+// and WithOnTimeoutV3 to also get the shutdown reason.
 func WithOnTimeout(fn func(Stage, string)) Option {
+	return func(m *Manager) {
+		if fn == nil {
+			m.onTimeOut = nil
+			return
+		}
+		m.onTimeOut = func(s Stage, ctx string, _ time.Duration, _ string) { fn(s, ctx) }
+	}
+}
+
+// WithOnTimeoutV2 is like WithOnTimeout, but fn also gets the time the notifier has been running,
+// measured from the start of its stage, or the time a lock has been held.
+// The elapsed time is zero for notifiers in stages that are skipped because the shutdown deadline has passed.
+// It replaces a function set with WithOnTimeout.
+func WithOnTimeoutV2(fn func(s Stage, ctx string, elapsed time.Duration)) Option {
+	return func(m *Manager) {
+		if fn == nil {
+			m.onTimeOut = nil
+			return
+		}
+		m.onTimeOut = func(s Stage, ctx string, elapsed time.Duration, _ string) { fn(s, ctx, elapsed) }
+	}
+}
+
+// WithOnTimeoutV3 is like WithOnTimeoutV2, but fn also gets the reason given for the shutdown,
+// see ShutdownWith, so timeouts can be correlated with what requested the shutdown.
+// It replaces a function set with WithOnTimeout or WithOnTimeoutV2.
+func WithOnTimeoutV3(fn func(s Stage, ctx string, elapsed time.Duration, reason string)) Option {
 	return func(m *Manager) {
 		m.onTimeOut = fn
 	}
 }
 
+// WithOnPanic allows you to get a notification when a panic in a shutdown function is recovered.
+// The stage, the context of the function, the recovered value and the stack trace are returned.
+// The function is called from the goroutine that panicked, so it may be called concurrently.
+// All recovered panics are also returned by Err.
+func WithOnPanic(fn func(s Stage, ctx string, recovered interface{}, stack []byte)) Option {
+	return func(m *Manager) {
+		m.onPanic = fn
+	}
+}
+
+// WithPanicPolicy sets what happens when a panic is recovered in a shutdown function.
+// The default, PanicRecover, continues the shutdown. PanicRepanic panics from Shutdown
+// when the stage has finished, and PanicExit exits at once, so bugs in shutdown code are not missed.
+// The panic is reported to the function set with WithOnPanic and logged regardless of the policy.
+func WithPanicPolicy(p PanicPolicy) Option {
+	return func(m *Manager) {
+		m.panicPolicy = p
+	}
+}
+
+// WithTriggerContext starts shutdown when ctx is done, so shutdown can be tied to a root context.
+// The cause of the cancellation is used as the reason of the shutdown, see ShutdownWith.
+// The goroutine watching ctx exits when shutdown has finished.
+// The option is not inherited by NewScope.
+func WithTriggerContext(ctx context.Context) Option {
+	return func(m *Manager) {
+		m.triggerCtx = ctx
+	}
+}
+
+// WithOnShutdownRequested sets a function that is called as soon as shutdown is requested,
+// before anything else is done, for instance to fail readiness probes at once.
+// ctx is the reason of the shutdown given to ShutdownWith, or the signal if it was started by OnSignal.
+// It is empty if Shutdown was called directly.
+// The function is called once per shutdown, also if Shutdown is called concurrently.
+// It is called synchronously, so it should return quickly.
+func WithOnShutdownRequested(fn func(ctx string)) Option {
+	return func(m *Manager) {
+		m.onShutdownRequested = fn
+	}
+}
+
+// WithOnStageComplete allows you to get a notification when each stage has finished.
+// The duration is measured from when the stage starts notifying until the last notifier
+// has completed or the stage has timed out. It is called for all stages, also empty ones.
+func WithOnStageComplete(fn func(s Stage, d time.Duration, timedOut bool)) Option {
+	return func(m *Manager) {
+		m.onStageComplete = fn
+	}
+}
+
+// WithOnShutdownComplete allows you to get a notification with the total
+// duration of the shutdown, when all stages have finished.
+func WithOnShutdownComplete(fn func(total time.Duration)) Option {
+	return func(m *Manager) {
+		m.onShutdownComplete = fn
+	}
+}
+
+// WithOnComplete sets a function that is called once when shutdown has finished,
+// also if stages timed out or were skipped. total is the duration of the shutdown,
+// and err contains the errors that occurred, as returned by Err.
+// It is called before Wait returns, so it is an alternative to waiting in a goroutine.
+func WithOnComplete(fn func(total time.Duration, err error)) Option {
+	return func(m *Manager) {
+		m.onComplete = fn
+	}
+}
+
+// WithStuckDump writes a dump of all goroutines to w when a stage times out.
+// The dump is preceded by the context of the notifiers that did not finish.
+// Disabled by default.
+func WithStuckDump(w io.Writer) Option {
+	return func(m *Manager) {
+		m.stuckDump = w
+	}
+}
+
+// WithStatusWriter writes the output of the status timer to w instead of the logger,
+// so the diagnostics about running notifiers can go to stderr or a debug file,
+// while the other events go to the logger. Each event is written as a line.
+// Hooks and the event buffer still receive the events. See WithStatusTimer.
+func WithStatusWriter(w io.Writer) Option {
+	return func(m *Manager) {
+		m.statusWriter = w
+	}
+}
+
+// WithPreDrainDelay will make Shutdown wait for d before shutdown is marked as started.
+// The delay is applied after functions added with OnBeforeShutdown have returned.
+// During the delay Started will return false and Lock will keep succeeding,
+// giving load balancers time to stop routing new requests to the service.
+func WithPreDrainDelay(d time.Duration) Option {
+	return func(m *Manager) {
+		m.preDrainDelay = d
+	}
+}
+
+// WithStageNames sets the names of the stages used in log messages, starting with the pre shutdown stage.
+// Stages without a name in names, or with an empty name, keep their default name, see Stage.String.
+// Names beyond the last stage are ignored.
+func WithStageNames(names ...string) Option {
+	return func(m *Manager) {
+		for i, name := range names {
+			if i < len(m.stageNames) && name != "" {
+				m.stageNames[i] = name
+			}
+		}
+	}
+}
+
+// WithBestEffortTimeout sets the timeout of notifiers registered with BestEffort,
+// counted from when they are notified. The stage timeout still applies.
+// A zero timeout means that only the stage timeout applies. The default is 1 second.
+func WithBestEffortTimeout(d time.Duration) Option {
+	return func(m *Manager) {
+		m.bestEffortTimeout = d
+	}
+}
+
+// WithExitAfter terminates the process with os.Exit(code) when shutdown has completed,
+// after the exit linger and the completion callbacks, so main does not have to wait
+// for the shutdown before it returns. Deferred functions are not run.
+// The process is not terminated if the shutdown is aborted, or if os.Exit is disabled with WithOSExit.
+// It takes precedence over the exit code given to OnSignal. It is not copied by NewScope,
+// since shutting down a scope should not terminate the process.
+func WithExitAfter(code int) Option {
+	return func(m *Manager) {
+		m.exitAfter = true
+		m.exitAfterCode = code
+	}
+}
+
+// WithExitLinger makes shutdown wait for d after the last stage has completed,
+// before Wait returns, the completion callbacks are called and os.Exit is called.
+// It gives load balancers and peers time to finish tearing down connections.
+// The linger is a fixed wall-clock duration, measured by the clock of the manager,
+// and is bounded by the hard deadline. ForceShutdown skips it, also while it is running.
+func WithExitLinger(d time.Duration) Option {
+	return func(m *Manager) {
+		m.exitLinger = d
+	}
+}
+
+// WithHardDeadline sets the maximum time from Shutdown is called until shutdown has finished,
+// regardless of the timeouts of the individual stages.
+// When the deadline is reached the current stage times out and the remaining stages are skipped.
+// Notifiers in skipped stages are not notified, but are reported to the function set with WithOnTimeout.
+// Disabled by default.
+func WithHardDeadline(d time.Duration) Option {
+	return func(m *Manager) {
+		m.hardDeadline = d
+	}
+}
+
+// WithClock sets the clock used for all timeouts and timers of the manager.
+// This allows tests to control time, for instance with a ManualClock.
+// When a clock other than the default is used, stage contexts are cancelled
+// rather than reaching their deadline when the stage times out.
+func WithClock(c Clock) Option {
+	return func(m *Manager) {
+		m.clock = c
+	}
+}
+
+// WithAbortableUntil allows a shutdown to be aborted with AbortShutdown
+// until stage s starts. Once s has started the shutdown cannot be aborted.
+// Disabled by default.
+func WithAbortableUntil(s Stage) Option {
+	return func(m *Manager) {
+		m.abortable = true
+		m.abortableUntil = s
+	}
+}
+
+// WithAdaptiveTimeout makes the timeout of each stage scale with the number of locks held
+// when the stage starts, so draining many requests in flight is given more time.
+// The timeout of a stage is base + perLock * LocksHeld(), computed once when the stage starts.
+// If a hard deadline is set the timeout is capped at the time left until the deadline.
+// The timeouts set with WithTimeout and WithTimeoutN are ignored for the stages,
+// but still apply to locks, which expire after the pre shutdown timeout.
+// A perLock of 0 or less disables the adaptive timeout.
+func WithAdaptiveTimeout(base, perLock time.Duration) Option {
+	return func(m *Manager) {
+		m.adaptiveBase = base
+		m.adaptivePerLock = perLock
+	}
+}
+
 // WithTimeout sets maximum delay to wait for each stage to finish.
 // When the timeout has expired for a stage the next stage will be initiated.
+// A zero timeout means that the stages have no timeout, and wait for their notifiers
+// until the hard deadline, if one is set. A negative timeout is logged and treated as zero.
 func WithTimeout(d time.Duration) Option {
 	return func(m *Manager) {
+		m.timeout = d
 		for i := range m.timeouts {
 			m.timeouts[i] = d
 		}
@@ -46,12 +447,87 @@ func WithTimeout(d time.Duration) Option {
 // WithTimeoutN set maximum delay to wait for a specific stage to finish.
 // When the timeout expired for a stage the next stage will be initiated.
 // The stage can be obtained by using the exported variables called 'Stage1, etc.
+// Zero and negative timeouts are handled like in WithTimeout.
 func WithTimeoutN(s Stage, d time.Duration) Option {
 	return func(m *Manager) {
 		m.timeouts[s.n] = d
 	}
 }
 
+// WithDrainLocksBefore makes shutdown wait until all locks acquired with Lock have been released
+// before stage s starts, but no longer than timeout.
+// Locks cannot be acquired once shutdown has started, so this can be used to finish
+// requests in flight before the notifiers of s close the server.
+// The wait is not part of the timeout of the stage, but is capped by the hard deadline.
+func WithDrainLocksBefore(s Stage, timeout time.Duration) Option {
+	return func(m *Manager) {
+		m.drainLocks[s.n] = timeout
+	}
+}
+
+// WithTimeoutPolicy sets what happens when a stage times out.
+// If no stages are given the policy is set for all stages.
+// See TimeoutPolicy for the available policies. The default is Advance.
+func WithTimeoutPolicy(p TimeoutPolicy, stages ...Stage) Option {
+	return func(m *Manager) {
+		if len(stages) == 0 {
+			stages = []Stage{StagePS, Stage1, Stage2, Stage3}
+		}
+		for _, s := range stages {
+			m.timeoutPolicies[s.n] = p
+		}
+	}
+}
+
+// WithForceStage sets the stage that is run by ForceShutdown. The default is Stage3.
+func WithForceStage(s Stage) Option {
+	return func(m *Manager) {
+		m.forceStage = s
+	}
+}
+
+// WithSkipStages marks stages that are never used, so they are not run or logged
+// and their timeout is not applied.
+// Notifiers registered for a skipped stage are invalid, like notifiers for a stage that has already run.
+// If the pre shutdown stage is skipped, shutdown does not wait for locks to be released.
+func WithSkipStages(stages ...Stage) Option {
+	return func(m *Manager) {
+		for _, s := range stages {
+			m.skipped[s.n] = true
+		}
+	}
+}
+
+// WithStageMode sets whether the notifiers in a stage are notified at once (ParallelMode),
+// or one at the time in the order they were registered (SequentialMode).
+// The default is ParallelMode.
+func WithStageMode(s Stage, mode StageMode) Option {
+	return func(m *Manager) {
+		m.stageModes[s.n] = mode
+	}
+}
+
+// WithStageConcurrency limits how many notifiers in a stage are notified at the same time to n.
+// The notifiers are notified in batches of n in the order they were registered,
+// and each batch is notified when the previous batch has finished.
+// The stage timeout applies to the whole stage. If n is 0 or less, there is no limit. This is the default.
+func WithStageConcurrency(s Stage, n int) Option {
+	return func(m *Manager) {
+		m.stageConcurrency[s.n] = n
+	}
+}
+
+// WithIntraStageShuffle notifies the notifiers within a stage in a random order,
+// instead of the order they were registered in, to find code that depends on the order.
+// The order is taken from a random source seeded with seed, so a failing order can be reproduced.
+// Priorities, dependencies and sequential stages are respected.
+func WithIntraStageShuffle(seed int64) Option {
+	return func(m *Manager) {
+		m.shuffleSeed = seed
+		m.shuffle = rand.New(rand.NewSource(seed))
+	}
+}
+
 // WithWarningPrefix is printed before warnings.
 func WithWarningPrefix(s string) Option {
 	return func(m *Manager) {
@@ -66,9 +542,55 @@ func WithnErrorPrefix(s string) Option {
 	}
 }
 
+// WithSummary enables or disables a single line summary logged when shutdown has completed,
+// like "Shutdown complete: 3 stages, 2 notifiers timed out, total 4.2s".
+// The reason of the shutdown is added, if one was given.
+// The summary is sent as an EventShutdownCompleted event. Disabled by default.
+func WithSummary(b bool) Option {
+	return func(m *Manager) {
+		m.summary = b
+	}
+}
+
 // WithStatusTimer is the time between logging which notifiers are waiting to finish.
-func WithStatusTimer(statusTimer time.Duration) Option {
+// The status timer can be configured further with status options, like WithEscalation.
+func WithStatusTimer(statusTimer time.Duration, opts ...StatusOption) Option {
 	return func(m *Manager) {
 		m.statusTimer = statusTimer
+		for _, opt := range opts {
+			opt(m)
+		}
+	}
+}
+
+// ServerOption configures a server managed with ManageServer.
+type ServerOption func(*serverOptions)
+
+// serverOptions are the options given to ManageServer.
+type serverOptions struct {
+	noWrap bool
+}
+
+// WithoutHandlerWrap makes ManageServer leave the handler of the server as it is.
+// Use it if the handler is already wrapped, for instance with WrapHandlerDrain or WrapHandlerNamed,
+// or if requests in flight should not lock shutdown. srv.Shutdown still waits for active requests,
+// no longer than the timeout of the stage.
+func WithoutHandlerWrap() ServerOption {
+	return func(o *serverOptions) {
+		o.noWrap = true
+	}
+}
+
+// StatusOption configures the status timer. See WithStatusTimer.
+type StatusOption func(*Manager)
+
+// WithEscalation makes the status timer escalate when a notifier is still running
+// after it has been reported n times.
+// After n intervals a dump of all goroutines is logged along with the notifier,
+// and after 2n intervals the function set with WithOnTimeout is called for the notifier.
+// If n is 0 or less, only the single status line is logged. This is the default.
+func WithEscalation(n int) StatusOption {
+	return func(m *Manager) {
+		m.statusEscalation = n
 	}
 }
@@ -0,0 +1,52 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"bytes"
+	"runtime"
+	"strconv"
+)
+
+// goid returns the id of the calling goroutine, as printed in stack traces.
+func goid() uint64 {
+	var buf [64]byte
+	b := buf[:runtime.Stack(buf[:], false)]
+	// The trace starts with "goroutine 123 [running]:".
+	b = bytes.TrimPrefix(b, []byte("goroutine "))
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, _ := strconv.ParseUint(string(b), 10, 64)
+	return id
+}
+
+// enterShutdown records that the calling goroutine runs the shutdown of m,
+// or calls a function registered with m.
+// The returned function must be called when it is done.
+func (m *Manager) enterShutdown() func() {
+	id := goid()
+	m.reentM.Lock()
+	if m.reentrant == nil {
+		m.reentrant = make(map[uint64]int)
+	}
+	m.reentrant[id]++
+	m.reentM.Unlock()
+	return func() {
+		m.reentM.Lock()
+		if m.reentrant[id]--; m.reentrant[id] == 0 {
+			delete(m.reentrant, id)
+		}
+		m.reentM.Unlock()
+	}
+}
+
+// inShutdown returns true if the calling goroutine runs the shutdown of m,
+// or calls a function registered with m.
+// It is used to make calls to Shutdown and Wait from shutdown functions return at once.
+func (m *Manager) inShutdown() bool {
+	id := goid()
+	m.reentM.Lock()
+	defer m.reentM.Unlock()
+	return m.reentrant[id] > 0
+}
@@ -9,12 +9,35 @@
 // Package home: https://github.com/eikmadsen/shutdown
 package shutdown
 
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
 // Stage contains stage information.
 // Valid values for this are exported as variables StageN.
 type Stage struct {
 	n int
 }
 
+// Index returns the index of the stage, where 0 is the pre shutdown stage.
+func (s Stage) Index() int {
+	return s.n
+}
+
+// defaultStageNames are the names of the stages returned by Stage.String.
+var defaultStageNames = [4]string{"PreShutdown", "First", "Second", "Third"}
+
+// String returns the name of the stage, "PreShutdown", "First", "Second" or "Third".
+// A manager can use other names, see WithStageNames and Manager.StageName.
+func (s Stage) String() string {
+	if s.n < 0 || s.n >= len(defaultStageNames) {
+		return fmt.Sprintf("Stage%d", s.n)
+	}
+	return defaultStageNames[s.n]
+}
+
 // LogPrinter is an interface for writing logging information.
 // The writer must handle concurrent writes.
 type LogPrinter interface {
@@ -25,11 +48,23 @@ type LogPrinter interface {
 type iNotifier struct {
 	n          Notifier
 	calledFrom string
+	priority   int
+	bestEffort bool
+	labels     *map[string]string // See WithLabels, shared with the events of the notifier
+	dependsOn  []Notifier
+	deps       []chan chan struct{}
 }
 type fnNotify struct {
-	client   Notifier
-	internal iNotifier
-	cancel   chan struct{}
+	client    Notifier
+	internal  iNotifier
+	cancel    chan struct{}
+	cancelled func() // Called by callFn when cancel is closed, may be nil
+}
+
+// progress is the latest progress reported by a notifier.
+type progress struct {
+	fraction float64
+	msg      string
 }
 
 type logWrapper struct {
@@ -44,8 +79,9 @@ func (l logWrapper) Printf(format string, v ...interface{}) {
 // once the application shuts down.
 // When you have performed your shutdown actions close the channel you are given.
 type Notifier struct {
-	c chan chan struct{}
-	m *Manager
+	c    chan chan struct{}
+	m    *Manager
+	site string // Where the notifier was registered, if lock tracking is enabled
 }
 
 // Valid returns true if it can be used as a notifier. If false shutdown has already started
@@ -53,16 +89,92 @@ func (n Notifier) Valid() bool {
 	return n.c != nil && n.m != nil
 }
 
+// Site returns the file and line where the notifier was registered, as "file:line".
+// The site is only recorded if lock tracking is enabled, see WithLockTracking.
+// An empty string is returned if it was not recorded or the notifier is invalid.
+func (n Notifier) Site() string {
+	return n.site
+}
+
 // Notify returns a channel to listen to for shutdown events.
+// The channel is buffered, so the notification is kept until it is read,
+// even if it is read after the stage has timed out.
+// Exactly one notification is sent on the channel.
+// For notifiers returned by functions like FirstFn the channel is closed after the notification,
+// so "for range n.Notify()" ends. For other notifiers the channel is left open, since it is
+// usually received from in a select loop together with other channels, where a closed channel
+// would be selected again and again. Receive once, or range until you close the notification.
 func (n Notifier) Notify() <-chan chan struct{} {
 	return n.c
 }
 
+// Skipped returns true if the stage of the notifier was skipped by ForceShutdown.
+// The notifier then receives a notification when the stage is skipped rather than
+// when it runs, and nothing waits for it, so the shutdown actions can be aborted.
+func (n Notifier) Skipped() bool {
+	if !n.Valid() {
+		return false
+	}
+	n.m.sqM.Lock()
+	defer n.m.sqM.Unlock()
+	return n.m.skippedNotifiers[n.c]
+}
+
+// Done waits for the shutdown notification and returns a function
+// that must be called when your shutdown actions have completed.
+// Calling the returned function more than once has no effect.
+// If the notifier is invalid, a function that does nothing is returned at once.
+func (n Notifier) Done() func() {
+	if !n.Valid() {
+		return func() {}
+	}
+	v, ok := <-n.c
+	if !ok {
+		return func() {}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(v) })
+	}
+}
+
+// Progress reports how far the shutdown actions of the notifier have come.
+// fraction should be between 0 and 1, and msg describes the current work.
+// The latest progress is included when the status timer logs that the
+// notifier is still running, see WithStatusTimer.
+// It is safe to call Progress from any goroutine.
+func (n Notifier) Progress(fraction float64, msg string) {
+	if !n.Valid() {
+		return
+	}
+	n.m.sqM.Lock()
+	if n.m.progress == nil {
+		n.m.progress = make(map[chan chan struct{}]progress)
+	}
+	// Progress of a function notifier is stored for the internal notifier the stage waits for.
+	c := n.c
+	for _, q := range n.m.shutdownFnQueue {
+		for _, fn := range q {
+			if fn.client.c == n.c {
+				c = fn.internal.n.c
+			}
+		}
+	}
+	n.m.progress[c] = progress{fraction: fraction, msg: msg}
+	n.m.sqM.Unlock()
+}
+
 // Cancel a Notifier.
 // This will remove a notifier from the shutdown queue,
 // and it will not be signalled when shutdown starts.
+// The manager keeps no reference to a removed notifier, and the goroutine
+// waiting to call the function of a notifier returned by for instance FirstFn exits.
+// The Notify channel is not closed, so a goroutine receiving from it must be stopped by the caller.
 // If the shutdown has already started this will not have any effect,
-// but a goroutine will wait for the notifier to be triggered.
+// but a goroutine will wait for the notifier to be triggered and close the notification,
+// until the stage of the notifier has finished.
+// Cancel never blocks, and cancelling a notifier that has been cancelled or has fired does nothing.
+// It is safe to call Cancel from several goroutines.
 func (s Notifier) Cancel() {
 	if !s.Valid() {
 		return
@@ -70,93 +182,220 @@ func (s Notifier) Cancel() {
 	s.m.srM.RLock()
 	if s.m.shutdownRequested.Load() {
 		s.m.srM.RUnlock()
-		// Wait until we get the notification and close it:
-		go func() {
-			v := <-s.c
-			close(v)
-		}()
+		s.m.sqM.Lock()
+		stage := s.stage()
+		var done chan struct{}
+		if stage >= 0 {
+			done = s.m.stageDone[stage]
+		}
+		s.m.sqM.Unlock()
+		if done != nil {
+			go s.closeNotification(done)
+		}
 		return
 	}
 	s.m.srM.RUnlock()
 	s.m.sqM.Lock()
-	var a chan chan struct{}
-	var b chan chan struct{}
-	a = s.c
-	for n, sdq := range s.m.shutdownQueue {
-		for i, qi := range sdq {
-			b = qi.n.c
-			if a == b {
-				s.m.shutdownQueue[n] = append(s.m.shutdownQueue[n][:i], s.m.shutdownQueue[n][i+1:]...)
+	s.remove()
+	s.m.sqM.Unlock()
+}
+
+// CancelWait will cancel a Notifier, or wait for it to become active if its stage has been reached.
+// This will remove a notifier from the shutdown queue, and it will not be signalled when shutdown starts.
+// If the notifier is invalid (requested after its stage has started), it will return at once.
+// If the stage of the notifier is running, this will wait for the notifier to be called and close it.
+// If the notification has already been received, CancelWait returns when the stage has finished.
+func (s Notifier) CancelWait() {
+	_ = s.CancelWaitContext(context.Background())
+}
+
+// CancelWaitContext is like CancelWait, but will stop waiting for the notifier
+// to become active if ctx is cancelled. In that case the error of the context is returned,
+// and the notification is closed in the background when it arrives.
+func (s Notifier) CancelWaitContext(ctx context.Context) error {
+	if !s.Valid() {
+		return nil
+	}
+	s.m.sqM.Lock()
+	stage := s.stage()
+	current := s.m.currentStage.n
+	if stage < 0 || stage > current {
+		// Cancelled already or the stage has not been reached.
+		s.remove()
+		s.m.sqM.Unlock()
+		return nil
+	}
+	done := s.m.stageDone[stage]
+	s.m.sqM.Unlock()
+
+	if stage < current {
+		// The stage has passed, close the notification if it wasn't received.
+		select {
+		case v, ok := <-s.c:
+			if ok {
+				close(v)
 			}
+		default:
 		}
-		for i, fn := range s.m.shutdownFnQueue[n] {
-			b = fn.client.c
-			if a == b {
-				// Find the matching internal and remove that.
-				for i := range s.m.shutdownQueue[n] {
-					b = s.m.shutdownQueue[n][i].n.c
-					if fn.internal.n.c == b {
-						s.m.shutdownQueue[n] = append(s.m.shutdownQueue[n][:i], s.m.shutdownQueue[n][i+1:]...)
-						break
-					}
-				}
-				// Cancel, so the goroutine exits.
-				close(fn.cancel)
-				// Remove this
-				s.m.shutdownFnQueue[n] = append(s.m.shutdownFnQueue[n][:i], s.m.shutdownFnQueue[n][i+1:]...)
+		return nil
+	}
+
+	// Wait until we get the notification and close it.
+	// If it has already been received, the stage finishing ends the wait.
+	select {
+	case v, ok := <-s.c:
+		if ok {
+			close(v)
+		}
+		return nil
+	case <-done:
+		s.closeNotification(done)
+		return nil
+	case <-ctx.Done():
+		go s.closeNotification(done)
+		return ctx.Err()
+	}
+}
+
+// closeNotification waits for the notification and closes it.
+// It returns when done is closed, closing the notification if it has been sent but not received.
+func (s Notifier) closeNotification(done <-chan struct{}) {
+	select {
+	case v, ok := <-s.c:
+		if ok {
+			close(v)
+		}
+	case <-done:
+		select {
+		case v, ok := <-s.c:
+			if ok {
+				close(v)
 			}
+		default:
 		}
 	}
-	s.m.sqM.Unlock()
 }
 
-// CancelWait will cancel a Notifier, or wait for it to become active if shutdown has been started.
-// This will remove a notifier from the shutdown queue, and it will not be signalled when shutdown starts.
-// If the notifier is invalid (requested after its stage has started), it will return at once.
-// If the shutdown has already started, this will wait for the notifier to be called and close it.
-func (s Notifier) CancelWait() {
+// Wait blocks until the stage of the notifier is reached and returns.
+// The notification is closed at once, so the stage does not wait for the caller,
+// which must coordinate the completion of its work in another way.
+// Wait also returns if the stage is finished without notifying, for instance
+// when it is skipped because the shutdown deadline has passed.
+// If the notifier is invalid or has been cancelled, Wait returns at once.
+func (s Notifier) Wait() {
 	if !s.Valid() {
 		return
 	}
 	s.m.sqM.Lock()
-	var a chan chan struct{}
-	var b chan chan struct{}
-	a = s.c
-	for n, sdq := range s.m.shutdownQueue {
-		for i, qi := range sdq {
-			b = qi.n.c
-			if a == b {
-				s.m.shutdownQueue[n] = append(s.m.shutdownQueue[n][:i], s.m.shutdownQueue[n][i+1:]...)
+	stage := s.stage()
+	if stage < 0 {
+		s.m.sqM.Unlock()
+		return
+	}
+	done := s.m.stageDone[stage]
+	s.m.sqM.Unlock()
+
+	select {
+	case v, ok := <-s.c:
+		if ok {
+			close(v)
+		}
+	case <-done:
+	}
+}
+
+// stage returns the stage index the notifier is queued in, or -1 if not queued.
+// The caller must hold sqM.
+func (s Notifier) stage() int {
+	for n := range s.m.shutdownQueue {
+		for _, qi := range s.m.shutdownQueue[n] {
+			if qi.n.c == s.c {
+				return n
 			}
 		}
+		for _, fn := range s.m.shutdownFnQueue[n] {
+			if fn.client.c == s.c {
+				return n
+			}
+		}
+	}
+	return -1
+}
+
+// queued returns the notifiers in ns that are still in the shutdown queues.
+// ns is filtered in place.
+func (m *Manager) queued(ns []Notifier) []Notifier {
+	m.sqM.Lock()
+	defer m.sqM.Unlock()
+	q := make(map[chan chan struct{}]bool)
+	for n := range m.shutdownQueue {
+		for _, qi := range m.shutdownQueue[n] {
+			q[qi.n.c] = true
+		}
+		for _, fn := range m.shutdownFnQueue[n] {
+			q[fn.client.c] = true
+		}
+	}
+	kept := ns[:0]
+	for _, n := range ns {
+		if q[n.c] {
+			kept = append(kept, n)
+		}
+	}
+	for i := len(kept); i < len(ns); i++ {
+		ns[i] = Notifier{}
+	}
+	return kept
+}
+
+// remove the notifier from the shutdown queues.
+// The caller must hold sqM.
+func (s Notifier) remove() {
+	delete(s.m.progress, s.c)
+	for n := range s.m.shutdownQueue {
 		for i, fn := range s.m.shutdownFnQueue[n] {
-			b = fn.client.c
-			if a == b {
-				// Find the matching internal and remove that.
-				for i := range s.m.shutdownQueue[n] {
-					b = s.m.shutdownQueue[n][i].n.c
-					if fn.internal.n.c == b {
-						s.m.shutdownQueue[n] = append(s.m.shutdownQueue[n][:i], s.m.shutdownQueue[n][i+1:]...)
-						break
-					}
-				}
-				// Cancel, so the goroutine exits.
+			if fn.client.c == s.c {
+				// Cancel, so the goroutine exits, and remove the internal notifier.
 				close(fn.cancel)
-				// Remove this
-				s.m.shutdownFnQueue[n] = append(s.m.shutdownFnQueue[n][:i], s.m.shutdownFnQueue[n][i+1:]...)
+				delete(s.m.progress, fn.internal.n.c)
+				s.m.shutdownFnQueue[n] = removeFn(s.m.shutdownFnQueue[n], i)
+				s.m.shutdownQueue[n], _ = removeNotifier(s.m.shutdownQueue[n], fn.internal.n.c)
+				return
 			}
 		}
+		var removed bool
+		if s.m.shutdownQueue[n], removed = removeNotifier(s.m.shutdownQueue[n], s.c); removed {
+			return
+		}
 	}
-	s.m.srM.Lock()
-	if s.m.shutdownRequested.Load() {
-		s.m.sqM.Unlock()
-		s.m.srM.Unlock()
-		// Wait until we get the notification and close it:
-		v := <-s.c
-		close(v)
+}
 
-		return
+// removeNotifier removes the notifier with channel c from q, and returns true if it was found.
+// The freed slot is cleared, and q is reallocated when it has shrunk to a quarter
+// of its capacity, so cancelled notifiers are not retained by the queue.
+func removeNotifier(q []iNotifier, c chan chan struct{}) ([]iNotifier, bool) {
+	for i := range q {
+		if q[i].n.c != c {
+			continue
+		}
+		copy(q[i:], q[i+1:])
+		q[len(q)-1] = iNotifier{}
+		q = q[:len(q)-1]
+		if len(q) <= cap(q)/4 {
+			q = append([]iNotifier(nil), q...)
+		}
+		return q, true
 	}
-	s.m.srM.Unlock()
-	s.m.sqM.Unlock()
+	return q, false
+}
+
+// removeFn removes the function notifier at index i from q, like removeNotifier.
+func removeFn(q []fnNotify, i int) []fnNotify {
+	copy(q[i:], q[i+1:])
+	q[len(q)-1] = fnNotify{}
+	q = q[:len(q)-1]
+	if len(q) <= cap(q)/4 {
+		q = append([]fnNotify(nil), q...)
+	}
+	return q
 }
@@ -4,14 +4,19 @@ package shutdown
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"os/exec"
+	"reflect"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -61,6 +66,178 @@ func TestBasic(t *testing.T) {
 	m.Wait()
 }
 
+func TestSecondShutdown(t *testing.T) {
+	for _, mode := range []SecondShutdownMode{SecondShutdownWait, SecondShutdownIgnore, SecondShutdownExit} {
+		m := New(WithTimeout(time.Second), WithSecondShutdown(mode), WithOSExit(false))
+		release := make(chan struct{})
+		running := make(chan struct{})
+		m.FirstFn(func() {
+			close(running)
+			<-release
+		})
+		first := make(chan struct{})
+		go func() {
+			m.Shutdown()
+			close(first)
+		}()
+		<-running
+		second := make(chan struct{})
+		go func() {
+			m.Shutdown()
+			close(second)
+		}()
+		select {
+		case <-second:
+			if mode != SecondShutdownIgnore {
+				t.Errorf("mode %d: second Shutdown returned before the first finished", mode)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if mode == SecondShutdownIgnore {
+				t.Errorf("mode %d: second Shutdown did not return at once", mode)
+			}
+		}
+		close(release)
+		<-first
+		<-second
+		// Calls after shutdown has finished return at once.
+		m.Shutdown()
+	}
+}
+
+func TestSignal(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	chs := make([]chan struct{}, 4)
+	for i := range chs {
+		chs[i] = make(chan struct{})
+	}
+	m.PreShutdownSignal(chs[0])
+	m.FirstSignal(chs[1])
+	m.SecondSignal(chs[2])
+	cancelled := make(chan struct{})
+	m.ThirdSignal(cancelled).Cancel()
+	m.ThirdSignal(chs[3])
+	// Nothing receives from the channels, the stages must not wait.
+	m.Shutdown()
+	for i, ch := range chs {
+		select {
+		case <-ch:
+		default:
+			t.Errorf("stage %d channel was not closed", i)
+		}
+	}
+	select {
+	case <-cancelled:
+		t.Error("cancelled channel was closed")
+	default:
+	}
+}
+
+func TestMinUptime(t *testing.T) {
+	c := NewManualClock(time.Now())
+	m := New(WithClock(c), WithMinUptime(time.Minute, false), WithTimeout(time.Hour), WithLogger(nil))
+	c.Advance(20 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		close(done)
+	}()
+	c.BlockUntil(1)
+	if m.Started() {
+		t.Fatal("shutdown started before the minimum uptime")
+	}
+	c.Advance(40 * time.Second)
+	<-done
+	if !m.Started() {
+		t.Fatal("shutdown not started after the minimum uptime")
+	}
+}
+
+func TestMinUptimeReject(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithMinUptime(time.Hour, true), WithTimeout(time.Second), WithLogger(rec.log))
+	defer close(startTimer(m, t))
+	m.Shutdown()
+	if m.Started() {
+		t.Fatal("shutdown should be rejected before the minimum uptime")
+	}
+	var logged bool
+	for _, e := range rec.get() {
+		logged = logged || strings.Contains(e.Message, "Shutdown rejected")
+	}
+	if !logged {
+		t.Error("rejected shutdown was not logged")
+	}
+}
+
+func TestFnIf(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	var enabled atomic.Bool
+	var called [4]atomic.Bool
+	cond := func() bool { return enabled.Load() }
+	m.PreShutdownFnIf(func() bool { return false }, func() { called[0].Store(true) })
+	m.FirstFnIf(cond, func() { called[1].Store(true) })
+	m.SecondFnIf(cond, func() { called[2].Store(true) })
+	m.ThirdFnIf(cond, func() { called[3].Store(true) })
+	// The condition is false when registering, but is evaluated when each stage runs.
+	m.PreShutdownFn(func() { enabled.Store(true) })
+	m.Shutdown()
+	if called[0].Load() {
+		t.Error("pre shutdown function was called with a false condition")
+	}
+	for i := 1; i < len(called); i++ {
+		if !called[i].Load() {
+			t.Errorf("stage %d function was not called with a true condition", i)
+		}
+	}
+}
+
+func TestStageByIndex(t *testing.T) {
+	m := newTestTimer()
+	if got := m.NumStages(); got != 4 {
+		t.Fatalf("want 4 stages, got %d", got)
+	}
+	want := []Stage{StagePS, Stage1, Stage2, Stage3}
+	for i := range want {
+		s, ok := m.StageByIndex(i)
+		if !ok {
+			t.Fatalf("stage %d not found", i)
+		}
+		if s != want[i] {
+			t.Errorf("stage %d: want %+v, got %+v", i, want[i], s)
+		}
+	}
+	for _, i := range []int{-1, 4, 100} {
+		if _, ok := m.StageByIndex(i); ok {
+			t.Errorf("stage %d: expected out of range", i)
+		}
+	}
+}
+
+func TestDone(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	f := m.First()
+	var ok bool
+	go func() {
+		done := f.Done()
+		ok = true
+		done()
+		// Repeated calls must not panic.
+		done()
+	}()
+	m.Shutdown()
+	if !ok {
+		t.Fatal("did not get expected shutdown signal")
+	}
+
+	// Invalid notifiers return at once.
+	done := m.First().Done()
+	done()
+	done()
+}
+
 func TestCancel(t *testing.T) {
 	m := newTestTimer()
 	defer close(startTimer(m, t))
@@ -226,6 +403,150 @@ func TestCancelWait4(t *testing.T) {
 	}
 }
 
+func TestCancelWaitContext(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	// Before shutdown the notifier is cancelled at once.
+	f2 := m.Second()
+	if err := f2.CancelWaitContext(context.Background()); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	f := m.First()
+	got := make(chan chan struct{})
+	go func() {
+		got <- <-f.Notify()
+	}()
+	errc := make(chan error, 1)
+	_ = m.FirstFn(func() {
+		// The notification has been received, but not closed,
+		// so CancelWaitContext must return when the context expires.
+		n := <-got
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		errc <- f.CancelWaitContext(ctx)
+		close(n)
+	})
+	m.Shutdown()
+	if err := <-errc; err != context.DeadlineExceeded {
+		t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	select {
+	case <-f2.Notify():
+		t.Fatal("got unexpected shutdown signal")
+	default:
+	}
+}
+
+func TestCancelAfterFire(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	f := m.First()
+	fn := m.FirstFn(func() {})
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		close(<-f.Notify())
+		// Cancelling after the notification has been received does nothing, and does not block.
+		f.Cancel()
+		f.CancelWait()
+		fn.Cancel()
+		fn.CancelWait()
+	}()
+	m.Shutdown()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("cancel after fire blocked")
+	}
+	// Cancelling after shutdown does nothing.
+	f.Cancel()
+	f.CancelWait()
+	fn.Cancel()
+	fn.CancelWait()
+}
+
+func TestCancelConcurrent(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	// Concurrent cancels before shutdown suppress the notification once.
+	before := m.Second()
+	// Concurrent cancels during shutdown close the notification once.
+	during := m.Third()
+	var wg sync.WaitGroup
+	cancel := func(n Notifier) {
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				n.Cancel()
+			}()
+			go func() {
+				defer wg.Done()
+				n.CancelWait()
+			}()
+		}
+	}
+	cancel(before)
+	wg.Wait()
+	_ = m.FirstFn(func() {
+		cancel(during)
+	})
+	m.Shutdown()
+	wg.Wait()
+	select {
+	case <-before.Notify():
+		t.Fatal("cancelled notifier was notified")
+	default:
+	}
+	select {
+	case <-during.Notify():
+		t.Fatal("notification of notifier cancelled during shutdown was not taken")
+	default:
+	}
+}
+
+func TestNotifierWait(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	// A cancelled notifier returns at once.
+	c := m.First()
+	c.Cancel()
+	c.Wait()
+
+	n := m.Second()
+	stage := make(chan Stage, 1)
+	go func() {
+		n.Wait()
+		s, _ := m.CurrentStage()
+		stage <- s
+	}()
+	start := time.Now()
+	m.Shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %v, the stage should not wait for the notifier", d)
+	}
+	if s := <-stage; s.Index() < Stage2.Index() {
+		t.Errorf("Wait returned in stage %d, before the stage of the notifier", s.Index())
+	}
+}
+
+func TestNotifierWaitSkipped(t *testing.T) {
+	m := New(WithHardDeadline(50*time.Millisecond), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	stuck := m.First()
+	go func() { <-stuck.Notify() }()
+	n := m.Third()
+	m.Shutdown()
+	// Stage 3 is skipped because the deadline has passed, so Wait must not block.
+	n.Wait()
+}
+
 type logBuffer struct {
 	buf bytes.Buffer
 	fn  func(string, ...interface{})
@@ -274,6 +595,99 @@ func TestContextLog(t *testing.T) {
 	}
 }
 
+func TestRegisterDuringShutdown(t *testing.T) {
+	for run := 0; run < 20; run++ {
+		m := New(WithTimeout(10*time.Second), WithLogger(nil))
+		var fired atomic.Int32
+		type registered struct {
+			n  Notifier
+			fn bool
+		}
+		var mu sync.Mutex
+		var valid []registered
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 1000 && !m.WaitTimeout(0); i++ {
+					var r registered
+					switch (g + i) % 7 {
+					case 0:
+						r.n = m.PreShutdown()
+					case 1:
+						r.n = m.First()
+					case 2:
+						r.n = m.Second()
+					case 3:
+						r.n = m.Third()
+					case 4:
+						r = registered{n: m.FirstFn(func() { fired.Add(1) }), fn: true}
+					case 5:
+						r = registered{n: m.SecondFn(func() { fired.Add(1) }), fn: true}
+					case 6:
+						r = registered{n: m.ThirdFn(func() { fired.Add(1) }), fn: true}
+					}
+					if !r.n.Valid() {
+						continue
+					}
+					if !r.fn {
+						go func(n Notifier) {
+							v := <-n.Notify()
+							fired.Add(1)
+							close(v)
+						}(r.n)
+					}
+					mu.Lock()
+					valid = append(valid, r)
+					mu.Unlock()
+				}
+			}(g)
+		}
+		m.Shutdown()
+		wg.Wait()
+
+		if got, want := int(fired.Load()), len(valid); got != want {
+			t.Fatalf("run %d: %d valid notifiers, but %d fired", run, want, got)
+		}
+		for _, r := range valid {
+			if !r.fn {
+				continue
+			}
+			select {
+			case <-r.n.Notify():
+			default:
+				t.Fatalf("run %d: function notifier registered at %s was not notified", run, r.n.Site())
+			}
+		}
+	}
+}
+
+func TestNotifierSite(t *testing.T) {
+	m := New(WithLogLockTimeouts(false))
+	_, file, line, _ := runtime.Caller(0)
+	n := m.First()
+	f := m.SecondFn(func() {})
+	if want := fmt.Sprintf("%s:%d", file, line+1); n.Site() != want {
+		t.Errorf("want site %q, got %q", want, n.Site())
+	}
+	if want := fmt.Sprintf("%s:%d", file, line+2); f.Site() != want {
+		t.Errorf("want site %q, got %q", want, f.Site())
+	}
+	var buf bytes.Buffer
+	if err := m.DumpPlan(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%s:%d", file, line+1); !strings.Contains(buf.String(), want) {
+		t.Errorf("plan should contain %q, got:\n%s", want, buf.String())
+	}
+
+	m = New(WithLockTracking(false))
+	if site := m.First().Site(); site != "" {
+		t.Errorf("want no site without lock tracking, got %q", site)
+	}
+}
+
 func TestFnCancelWait(t *testing.T) {
 	m := newTestTimer()
 	defer close(startTimer(m, t))
@@ -328,6 +742,49 @@ func TestNilNotifier(t *testing.T) {
 	<-testDone
 }
 
+// register returns a notifier for stage s, using the function variant if fn is set.
+func register(m *Manager, s Stage, fn bool) Notifier {
+	if fn {
+		return [...]func(func(), ...interface{}) Notifier{m.PreShutdownFn, m.FirstFn, m.SecondFn, m.ThirdFn}[s.n](func() {})
+	}
+	return [...]func(...interface{}) Notifier{m.PreShutdown, m.First, m.Second, m.Third}[s.n]()
+}
+
+// TestRegistrationContract checks which notifiers are valid at each point of the shutdown.
+func TestRegistrationContract(t *testing.T) {
+	stages := []Stage{StagePS, Stage1, Stage2, Stage3}
+	check := func(m *Manager, when string, valid func(s Stage) bool) {
+		for _, s := range stages {
+			for _, fn := range []bool{false, true} {
+				n := register(m, s, fn)
+				if n.Valid() != valid(s) {
+					t.Errorf("%s: stage %d (fn: %v): want valid %v, got %v", when, s.n, fn, valid(s), n.Valid())
+				}
+				if n.Valid() {
+					n.Cancel()
+				}
+			}
+		}
+	}
+
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	check(m, "before shutdown", func(Stage) bool { return true })
+	for _, running := range stages {
+		running := running
+		_ = m.onFunc(running.n, 0, func(context.Context) {
+			check(m, fmt.Sprintf("during stage %d", running.n), func(s Stage) bool { return s.n > running.n })
+		}, nil)
+	}
+	m.Shutdown()
+	check(m, "after shutdown", func(Stage) bool { return false })
+
+	// Stages that are skipped are not valid after shutdown either.
+	m = newTestTimer()
+	m.ShutdownWithDeadline(time.Now())
+	check(m, "after skipped stages", func(Stage) bool { return false })
+}
+
 func TestNilNotifierCancel(t *testing.T) {
 	m := newTestTimer()
 	defer close(startTimer(m, t))
@@ -374,122 +831,898 @@ func TestNilNotifierCancelWait(t *testing.T) {
 	<-testDone
 }
 
-func TestNilNotifierFollowing(t *testing.T) {
-	m := newTestTimer()
+func TestNilNotifierFollowing(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	var reached = make(chan struct{})
+	var finished = make(chan struct{})
+	var testDone = make(chan struct{})
+	_ = m.PreShutdownFn(func() { close(reached); <-finished })
+	go func() { m.Shutdown(); close(testDone) }()
+
+	// Wait for stage 3
+	<-reached
+
+	tests := []Notifier{m.First(), m.Second(), m.Third(),
+		m.FirstFn(func() {}), m.SecondFn(func() {}), m.ThirdFn(func() {})}
+
+	for i := range tests {
+		if !tests[i].Valid() {
+			t.Errorf("Expected test %d to NOT be nil.", i)
+			continue
+		}
+		tests[i].Cancel()
+	}
+	close(finished)
+	<-testDone
+}
+
+func TestWait(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	ok := make(chan bool)
+	go func() {
+		m.Wait()
+		close(ok)
+	}()
+	// Wait a little - enough to fail very often.
+	time.Sleep(time.Millisecond * 10)
+
+	select {
+	case <-ok:
+		t.Fatal("Wait returned before shutdown finished")
+	default:
+	}
+
+	m.Shutdown()
+
+	// ok should return, otherwise we wait for timeout, which will fail the test
+	<-ok
+}
+
+func TestStartedCh(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	c := m.StartedCh()
+	if c != m.StartedCh() {
+		t.Fatal("StartedCh returned different channels")
+	}
+	select {
+	case <-c:
+		t.Fatal("StartedCh closed before shutdown")
+	default:
+	}
+	m.Shutdown()
+	select {
+	case <-c:
+	default:
+		t.Fatal("StartedCh not closed after shutdown")
+	}
+	if c != m.StartedCh() {
+		t.Fatal("StartedCh returned a different channel after shutdown")
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	if m.WaitTimeout(time.Millisecond * 10) {
+		t.Fatal("WaitTimeout returned true before shutdown")
+	}
+	m.Shutdown()
+	if !m.WaitTimeout(time.Millisecond * 10) {
+		t.Fatal("WaitTimeout returned false after shutdown")
+	}
+	// Wait must still return.
+	m.Wait()
+}
+
+func TestWaitContext(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.WaitContext(ctx); err != context.Canceled {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- m.WaitContext(context.Background())
+		}()
+	}
+	m.Shutdown()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	m := New(WithTimeout(time.Millisecond * 400))
+
+	defer close(startTimer(m, t))
+	f := m.First()
+	go func() {
+		<-f.Notify()
+	}()
+	tn := time.Now()
+	m.Shutdown()
+	dur := time.Since(tn)
+	if dur > time.Second || dur < time.Millisecond*50 {
+		t.Fatalf("timeout time was unexpected:%v", time.Since(tn))
+	}
+	if !m.Started() {
+		t.Fatal("got unexpected shutdown signal")
+	}
+}
+
+func TestTimeoutN(t *testing.T) {
+	m := New(WithTimeout(time.Millisecond*2000), WithTimeoutN(Stage1, time.Millisecond*100))
+
+	defer close(startTimer(m, t))
+	f := m.First()
+	go func() {
+		<-f.Notify()
+	}()
+	tn := time.Now()
+	m.Shutdown()
+	dur := time.Since(tn)
+	if dur > time.Second || dur < time.Millisecond*50 {
+		t.Fatalf("timeout time was unexpected:%v", time.Since(tn))
+	}
+	if !m.Started() {
+		t.Fatal("got unexpected shutdown signal")
+	}
+}
+
+func TestTimeoutAccessors(t *testing.T) {
+	m := New()
+	if got := m.Timeout(); got != 5*time.Second {
+		t.Errorf("want default timeout 5s, got %v", got)
+	}
+	m = New(WithTimeout(time.Second), WithTimeoutN(Stage2, time.Minute))
+	if got := m.Timeout(); got != time.Second {
+		t.Errorf("want timeout 1s, got %v", got)
+	}
+	if got := m.TimeoutN(Stage1); got != time.Second {
+		t.Errorf("want stage 1 timeout 1s, got %v", got)
+	}
+	if got := m.TimeoutN(Stage2); got != time.Minute {
+		t.Errorf("want stage 2 timeout 1m, got %v", got)
+	}
+	m.SetTimeoutN(Stage3, time.Hour)
+	if got := m.TimeoutN(Stage3); got != time.Hour {
+		t.Errorf("want stage 3 timeout 1h, got %v", got)
+	}
+}
+
+func TestZeroTimeout(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage1, 0), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	var finished atomic.Bool
+	m.FirstFn(func() {
+		time.Sleep(50 * time.Millisecond)
+		finished.Store(true)
+	})
+	var before bool
+	m.SecondFn(func() { before = finished.Load() })
+	m.Shutdown()
+	if !before {
+		t.Error("stage 1 has no timeout, but stage 2 started before it finished")
+	}
+}
+
+func TestZeroTimeoutHardDeadline(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage1, 0), WithHardDeadline(100*time.Millisecond), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	stuck := m.First()
+	go func() { <-stuck.Notify() }()
+	start := time.Now()
+	m.Shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %v, it should be bounded by the hard deadline", d)
+	}
+}
+
+func TestNegativeTimeout(t *testing.T) {
+	var rec eventRecorder
+	m := New(WithLogger(rec.log), WithTimeoutN(Stage1, -time.Second))
+	if got := m.TimeoutN(Stage1); got != 0 {
+		t.Errorf("want negative timeout treated as zero, got %v", got)
+	}
+	m.SetTimeout(-time.Second)
+	if got := m.Timeout(); got != 0 {
+		t.Errorf("want negative timeout treated as zero, got %v", got)
+	}
+	var warnings int
+	for _, e := range rec.get() {
+		if e.Level == LevelWarn && strings.Contains(e.Message, "Negative timeout") {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("want 2 warnings about negative timeouts, got %d", warnings)
+	}
+
+	// One warning for each option, although WithTimeout sets every stage.
+	var all eventRecorder
+	m = New(WithLogger(all.log), WithTimeout(-1), WithTimeoutN(Stage2, -time.Second))
+	warnings = 0
+	for _, e := range all.get() {
+		if e.Level == LevelWarn && strings.Contains(e.Message, "Negative timeout") {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Errorf("want 2 warnings about negative timeouts, got %d", warnings)
+	}
+	for _, s := range []Stage{StagePS, Stage1, Stage2, Stage3} {
+		if got := m.TimeoutN(s); got != 0 {
+			t.Errorf("stage %v: want negative timeout treated as zero, got %v", s, got)
+		}
+	}
+}
+
+func TestSetTimeoutDuringShutdown(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	_ = m.FirstFn(func() {
+		// The current stage is not affected.
+		m.SetTimeoutN(Stage1, time.Millisecond)
+		// But the following is.
+		m.SetTimeoutN(Stage2, time.Millisecond*20)
+	})
+	f := m.Second()
+	go func() {
+		<-f.Notify()
+	}()
+	tn := time.Now()
+	m.Shutdown()
+	if dur := time.Since(tn); dur > time.Second {
+		t.Fatalf("timeout time was unexpected:%v", dur)
+	}
+	// After shutdown nothing can be changed.
+	m.SetTimeout(time.Hour)
+	t1, t3 := m.TimeoutN(Stage1), m.TimeoutN(Stage3)
+	if t1 != time.Second*300 {
+		t.Errorf("stage 1 timeout was changed during stage 1: %v", t1)
+	}
+	if t3 == time.Hour {
+		t.Errorf("timeout was changed after shutdown")
+	}
+}
+
+func TestSetTimeoutRace(t *testing.T) {
+	m := New(WithTimeout(time.Millisecond * 100))
+	defer close(startTimer(m, t))
+	for i := 0; i < 20; i++ {
+		_ = m.FirstFn(func() { time.Sleep(time.Millisecond) })
+		_ = m.SecondFn(func() { time.Sleep(time.Millisecond) })
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Wait a little between iterations, so the shutdown isn't starved on a single CPU.
+			for !m.WaitTimeout(time.Millisecond) {
+				m.SetTimeoutN(Stage{n: i}, time.Millisecond*time.Duration(50+i))
+				m.SetTimeout(time.Millisecond * 100)
+				if l := m.Lock(); l != nil {
+					l()
+				}
+			}
+		}(i)
+	}
+	m.Shutdown()
+	wg.Wait()
+}
+
+func TestIndependentManagers(t *testing.T) {
+	var recA, recB eventRecorder
+	a := New(WithLogger(recA.log), WithTimeout(200*time.Millisecond))
+	b := New(WithLogger(recB.log), WithTimeout(time.Second))
+	defer close(startTimer(a, t))
+	defer close(startTimer(b, t))
+
+	// a has a notifier that never finishes, b must not be held back by it.
+	stuck := a.First("stuck in a")
+	go func() { <-stuck.Notify() }()
+	var aCalled, bCalled atomic.Int32
+	a.SecondFn(func() { aCalled.Add(1) })
+	b.SecondFn(func() { bCalled.Add(1) })
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		a.Shutdown()
+	}()
+	go func() {
+		defer wg.Done()
+		b.Shutdown()
+	}()
+	if !b.WaitTimeout(100 * time.Millisecond) {
+		t.Fatal("b was held back by a")
+	}
+	if a.WaitTimeout(0) {
+		t.Fatal("a finished before its timeout")
+	}
+	wg.Wait()
+
+	if aCalled.Load() != 1 || bCalled.Load() != 1 {
+		t.Fatalf("want 1 call on each, got a:%d, b:%d", aCalled.Load(), bCalled.Load())
+	}
+	for _, e := range recB.get() {
+		if strings.Contains(e.Context, "stuck in a") {
+			t.Errorf("event from a logged by b: %+v", e)
+		}
+	}
+	if len(recA.get()) == 0 {
+		t.Error("a logged no events")
+	}
+	if a.TimeoutN(Stage1) == b.TimeoutN(Stage1) {
+		t.Error("timeouts should not be shared")
+	}
+}
+
+func TestNewScope(t *testing.T) {
+	var rec eventRecorder
+	parent := New(WithLogger(rec.log), WithTimeout(time.Second), WithTimeoutN(Stage3, 456*time.Millisecond))
+	defer close(startTimer(parent, t))
+
+	var parentCalled atomic.Int32
+	parent.FirstFn(func() { parentCalled.Add(1) })
+	for i := 0; i < 3; i++ {
+		child := parent.NewScope(WithTimeoutN(Stage1, 50*time.Millisecond))
+		if got := child.TimeoutN(Stage3); got != 456*time.Millisecond {
+			t.Fatalf("want timeout inherited from parent, got %v", got)
+		}
+		if got := child.TimeoutN(Stage1); got != 50*time.Millisecond {
+			t.Fatalf("want timeout set by option, got %v", got)
+		}
+		var childCalled atomic.Bool
+		child.FirstFn(func() { childCalled.Store(true) }, "child")
+		child.Shutdown()
+		if !childCalled.Load() {
+			t.Fatal("child notifier not called")
+		}
+		if parent.Started() || parentCalled.Load() != 0 {
+			t.Fatal("child shutdown affected the parent")
+		}
+	}
+	if parent.TimeoutN(Stage1) != time.Second {
+		t.Error("child options changed the parent")
+	}
+	var logged bool
+	for _, e := range rec.get() {
+		logged = logged || e.Kind == EventShutdownStarted
+	}
+	if !logged {
+		t.Error("child should use the logger of the parent")
+	}
+	parent.Shutdown()
+	if parentCalled.Load() != 1 {
+		t.Error("parent notifier not called")
+	}
+}
+
+func TestNewScopeLogOptions(t *testing.T) {
+	var mu sync.Mutex
+	var lines []string
+	parent := New(WithLogPrinter(func(format string, v ...interface{}) {
+		mu.Lock()
+		lines = append(lines, fmt.Sprintf(format, v...))
+		mu.Unlock()
+	}), WithTimeout(time.Second))
+	scope := parent.NewScope(WithWarningPrefix("SCOPE-WARN: "))
+	scope.log(Event{Level: LevelWarn, Message: "scope"})
+	parent.log(Event{Level: LevelWarn, Message: "parent"})
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"SCOPE-WARN: scope", "WARN: parent"}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("want %q, got %q", want, lines)
+	}
+
+	tm := NewForTesting()
+	ts := tm.NewScope()
+	ts.Shutdown()
+	if len(ts.Events()) == 0 {
+		t.Error("scope of a testing manager should keep its events")
+	}
+	if events := tm.Events(); len(events) != 0 {
+		t.Errorf("scope events should not be kept by the parent, got %v", events)
+	}
+}
+
+func TestAbortShutdown(t *testing.T) {
+	m := New(WithAbortableUntil(Stage2), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	if m.AbortShutdown() {
+		t.Fatal("abort should fail before shutdown")
+	}
+
+	var first, second atomic.Int32
+	m.FirstFn(func() {
+		first.Add(1)
+		if !m.AbortShutdown() {
+			t.Error("abort should succeed in stage 1")
+		}
+	})
+	m.SecondFn(func() { second.Add(1) })
+	m.Shutdown()
+
+	if m.Started() {
+		t.Fatal("shutdown should not be started after abort")
+	}
+	if second.Load() != 0 {
+		t.Fatal("stage 2 should not run after abort")
+	}
+	if m.StageDone(StagePS) {
+		t.Fatal("stages should be reset after abort")
+	}
+	l := m.Lock()
+	if l == nil {
+		t.Fatal("Lock should succeed after abort")
+	}
+	l()
+
+	// Shutdown again, this time it can't be aborted in stage 2.
+	m.SecondFn(func() {
+		if m.AbortShutdown() {
+			t.Error("abort should fail in stage 2")
+		}
+	})
+	m.Shutdown()
+	if !m.Started() || !m.StageDone(Stage3) {
+		t.Fatal("shutdown should have finished")
+	}
+	if first.Load() != 1 || second.Load() != 1 {
+		t.Errorf("want each function called once, got first: %d, second: %d", first.Load(), second.Load())
+	}
+	if m.AbortShutdown() {
+		t.Error("abort should fail after shutdown")
+	}
+}
+
+func TestAbortShutdownBeforeStages(t *testing.T) {
+	m := New(WithAbortableUntil(Stage2), WithTimeout(time.Second), WithLogger(nil))
+	defer close(startTimer(m, t))
+	var abort atomic.Bool
+	abort.Store(true)
+	m.OnBeforeShutdown(func() {
+		if abort.Swap(false) && !m.AbortShutdown() {
+			t.Error("abort should succeed before the pre shutdown stage")
+		}
+	})
+	var queued int
+	m.PreShutdownFn(func() {
+		m.sqM.Lock()
+		queued = len(m.shutdownFnQueue[StagePS.n])
+		m.sqM.Unlock()
+	})
+	m.Shutdown()
+	if m.Started() {
+		t.Fatal("shutdown should be aborted")
+	}
+	m.Shutdown()
+	// The function above and the internal function waiting for locks.
+	if queued != 2 {
+		t.Errorf("want 2 functions in the pre shutdown stage, got %d", queued)
+	}
+}
+
+func TestAbortShutdownDisabled(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	var aborted bool
+	m.FirstFn(func() { aborted = m.AbortShutdown() })
+	m.Shutdown()
+	if aborted {
+		t.Error("abort should fail without WithAbortableUntil")
+	}
+}
+
+func TestOnShutdownRequested(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	add := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+	m := New(WithOnShutdownRequested(func(ctx string) {
+		if ctx != "" {
+			t.Errorf("want empty context, got %q", ctx)
+		}
+		add("requested")
+	}), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+	m.OnBeforeShutdown(func() { add("before") })
+	m.PreShutdownFn(func() { add("pre shutdown") })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Shutdown()
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := strings.Join(order, ","), "requested,before,pre shutdown"; got != want {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestOnBeforeShutdown(t *testing.T) {
+	m := New(WithPreDrainDelay(50*time.Millisecond), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var order []string
+	m.OnBeforeShutdown(func() {
+		if m.Started() {
+			t.Error("shutdown marked started before OnBeforeShutdown returned")
+		}
+		l := m.Lock()
+		if l == nil {
+			t.Error("Lock failed while running OnBeforeShutdown")
+		} else {
+			l()
+		}
+		order = append(order, "first")
+	})
+	m.OnBeforeShutdown(func() { order = append(order, "second") })
+	m.OnBeforeShutdown(func() { panic("before shutdown") })
+	f := m.PreShutdownFn(func() { order = append(order, "pre shutdown") })
+
+	go m.Shutdown()
+	time.Sleep(20 * time.Millisecond)
+	if m.Started() {
+		t.Error("shutdown marked started during pre drain delay")
+	}
+	l := m.Lock()
+	if l == nil {
+		t.Fatal("Lock failed during pre drain delay")
+	}
+	l()
+	if !f.Valid() {
+		t.Fatal("notifier should be valid")
+	}
+	m.Wait()
+
+	if got, want := strings.Join(order, ","), "first,second,pre shutdown"; got != want {
+		t.Errorf("want order %q, got %q", want, got)
+	}
+	if errs, ok := m.Err().(Errors); !ok || len(errs) != 1 {
+		t.Errorf("want 1 recovered panic, got %v", m.Err())
+	}
+}
+
+func TestExitAfter(t *testing.T) {
+	if os.Getenv("SHUTDOWN_TEST_EXIT_AFTER") == "1" {
+		m := New(WithExitAfter(3), WithLogger(nil))
+		// Shutting down a scope does not exit.
+		m.NewScope().Shutdown()
+		m.Shutdown()
+		os.Exit(0)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestExitAfter$")
+	cmd.Env = append(os.Environ(), "SHUTDOWN_TEST_EXIT_AFTER=1")
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Fatalf("want exit code 3, got %v", err)
+	}
+}
+
+func TestExitLinger(t *testing.T) {
+	var completed atomic.Bool
+	m := New(WithExitLinger(100*time.Millisecond), WithTimeout(time.Second), WithOnShutdownComplete(func(time.Duration) { completed.Store(true) }))
+	defer close(startTimer(m, t))
+	var lastStage time.Time
+	m.ThirdFn(func() { lastStage = time.Now() })
+
+	go m.Shutdown()
+	time.Sleep(50 * time.Millisecond)
+	if completed.Load() {
+		t.Error("completion callback called during linger")
+	}
+	m.Wait()
+	if d := time.Since(lastStage); d < 100*time.Millisecond {
+		t.Errorf("Wait returned %v after the last stage, want at least 100ms", d)
+	}
+	if !completed.Load() {
+		t.Error("completion callback not called")
+	}
+
+	// The linger is bounded by the hard deadline.
+	m = New(WithExitLinger(time.Minute), WithHardDeadline(50*time.Millisecond), WithTimeout(time.Second))
+	start := time.Now()
+	m.Shutdown()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("linger not bounded by the hard deadline, took %v", d)
+	}
+}
+
+func TestTimeoutCallback(t *testing.T) {
+	var gotStage Stage
+	var gotCtx string
+	m := New(WithOnTimeout(func(s Stage, ctx string) {
+		gotStage = s
+		gotCtx = ctx
+	}), WithTimeout(time.Millisecond*2000), WithTimeoutN(Stage1, time.Millisecond*100))
+
+	defer close(startTimer(m, t))
+
+	const testctx = "lock context"
+	f := m.First(testctx)
+	go func() {
+		<-f.Notify()
+	}()
+	tn := time.Now()
+	m.Shutdown()
+	dur := time.Since(tn)
+	if dur > time.Second || dur < time.Millisecond*50 {
+		t.Errorf("timeout time was unexpected:%v (%v->%v)", dur, tn, time.Now())
+	}
+	if !m.Started() {
+		t.Fatal("got unexpected shutdown signal")
+	}
+	if gotStage != Stage1 {
+		t.Errorf("want stage 1, got %+v", gotStage)
+	}
+	if !strings.Contains(gotCtx, testctx) {
+		t.Errorf("want context to contain %q, got %q", testctx, gotCtx)
+	}
+}
+
+func TestLockTimeoutCallback(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	m := New(WithOnTimeout(func(s Stage, ctx string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if s == StagePS {
+			got = append(got, ctx)
+		}
+	}), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	const testctx = "leaking handler"
+	l := m.Lock(testctx)
+	defer l()
+	// The lock outlives the stage, since it was acquired with a longer timeout.
+	m.SetTimeoutN(StagePS, 50*time.Millisecond)
+	m.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	var found bool
+	for _, ctx := range got {
+		if strings.Contains(ctx, testctx) && strings.Contains(ctx, "shutdown_test.go") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("want timeout callback with lock caller, got %q", got)
+	}
+}
+
+func TestLockTracking(t *testing.T) {
+	got := make(chan string, 1)
+	m := New(WithOnTimeout(func(s Stage, ctx string) {
+		got <- ctx
+	}), WithLockTracking(false), WithTimeoutN(StagePS, 10*time.Millisecond))
 	defer close(startTimer(m, t))
-	var reached = make(chan struct{})
-	var finished = make(chan struct{})
-	var testDone = make(chan struct{})
-	_ = m.PreShutdownFn(func() { close(reached); <-finished })
-	go func() { m.Shutdown(); close(testDone) }()
-
-	// Wait for stage 3
-	<-reached
 
-	tests := []Notifier{m.First(), m.Second(), m.Third(),
-		m.FirstFn(func() {}), m.SecondFn(func() {}), m.ThirdFn(func() {})}
+	l := m.Lock("untracked")
+	ctx := <-got
+	l()
+	if strings.Contains(ctx, "shutdown_test.go") || !strings.Contains(ctx, "untracked") {
+		t.Errorf("want context without caller, got %q", ctx)
+	}
+}
 
-	for i := range tests {
-		if !tests[i].Valid() {
-			t.Errorf("Expected test %d to NOT be nil.", i)
-			continue
+func TestTryLock(t *testing.T) {
+	got := make(chan string, 1)
+	m := New(WithOnTimeout(func(s Stage, ctx string) {
+		select {
+		case got <- ctx:
+		default:
 		}
-		tests[i].Cancel()
+	}), WithTimeoutN(StagePS, 20*time.Millisecond), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	unlock, err := m.TryLock("try")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx := <-got; !strings.Contains(ctx, "try") || !strings.Contains(ctx, "shutdown_test.go") {
+		t.Errorf("want context with caller, got %q", ctx)
+	}
+	unlock()
+	m.Shutdown()
+	unlock, err = m.TryLock()
+	if !errors.Is(err, ErrShuttingDown) || unlock != nil {
+		t.Errorf("want ErrShuttingDown after shutdown, got %v", err)
 	}
-	close(finished)
-	<-testDone
 }
 
-func TestWait(t *testing.T) {
-	m := newTestTimer()
+func TestLockLeaseTimeout(t *testing.T) {
+	got := make(chan string, 1)
+	m := New(WithOnTimeout(func(s Stage, ctx string) {
+		got <- ctx
+	}), WithLockLeaseTimeout(20*time.Millisecond), WithTimeout(time.Second), WithLogger(nil))
 	defer close(startTimer(m, t))
-	ok := make(chan bool)
-	go func() {
-		m.Wait()
-		close(ok)
-	}()
-	// Wait a little - enough to fail very often.
-	time.Sleep(time.Millisecond * 10)
 
+	l := m.Lock("leaked")
 	select {
-	case <-ok:
-		t.Fatal("Wait returned before shutdown finished")
-	default:
+	case ctx := <-got:
+		if !strings.Contains(ctx, "leaked") || !strings.Contains(ctx, "shutdown_test.go") {
+			t.Errorf("want context with caller, got %q", ctx)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("lock was not released after the lease")
 	}
+	if n := m.LocksHeld(); n != 0 {
+		t.Errorf("want 0 locks held, got %d", n)
+	}
+	// Unlocking after the lease has expired, or twice, has no effect.
+	l()
+	l()
 
+	start := time.Now()
 	m.Shutdown()
-
-	// ok should return, otherwise we wait for timeout, which will fail the test
-	<-ok
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("shutdown took %v, the leaked lock should not block it", d)
+	}
 }
 
-func TestTimeout(t *testing.T) {
-	m := New(WithTimeout(time.Millisecond * 400))
-
+func TestDrainLocksBefore(t *testing.T) {
+	m := New(WithDrainLocksBefore(StagePS, time.Second), WithTimeout(time.Second), WithLogger(nil))
 	defer close(startTimer(m, t))
-	f := m.First()
+
+	l := m.Lock()
+	var released atomic.Bool
 	go func() {
-		<-f.Notify()
+		time.Sleep(50 * time.Millisecond)
+		released.Store(true)
+		l()
+	}()
+	var held int
+	var before bool
+	m.PreShutdownFn(func() {
+		held = m.LocksHeld()
+		before = released.Load()
+	})
+	go func() {
+		// Wait for shutdown to start before the lock is released.
+		<-m.StartedCh()
+		if l := m.Lock(); l != nil {
+			l()
+			t.Error("lock acquired after shutdown started")
+		}
 	}()
-	tn := time.Now()
 	m.Shutdown()
-	dur := time.Since(tn)
-	if dur > time.Second || dur < time.Millisecond*50 {
-		t.Fatalf("timeout time was unexpected:%v", time.Since(tn))
+	if !before || held != 0 {
+		t.Errorf("pre shutdown stage started with %d lock(s) held", held)
 	}
-	if !m.Started() {
-		t.Fatal("got unexpected shutdown signal")
+}
+
+func BenchmarkStarted(b *testing.B) {
+	m := New()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if m.Started() {
+				b.Fatal("started")
+			}
+		}
+	})
+}
+
+func BenchmarkLock(b *testing.B) {
+	for _, tracking := range []bool{true, false} {
+		b.Run(fmt.Sprintf("tracking=%v", tracking), func(b *testing.B) {
+			m := New(WithLockTracking(tracking))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				m.Lock()()
+			}
+		})
 	}
 }
 
-func TestTimeoutN(t *testing.T) {
-	m := New(WithTimeout(time.Millisecond*2000), WithTimeoutN(Stage1, time.Millisecond*100))
+func TestStageCompleteCallback(t *testing.T) {
+	type result struct {
+		d        time.Duration
+		timedOut bool
+	}
+	var mu sync.Mutex
+	var got = map[Stage]result{}
+	var total time.Duration
+	m := New(WithOnStageComplete(func(s Stage, d time.Duration, timedOut bool) {
+		mu.Lock()
+		got[s] = result{d: d, timedOut: timedOut}
+		mu.Unlock()
+	}), WithOnShutdownComplete(func(d time.Duration) {
+		total = d
+	}), WithTimeout(time.Second), WithTimeoutN(Stage2, time.Millisecond*50))
 
 	defer close(startTimer(m, t))
-	f := m.First()
+	_ = m.FirstFn(func() { time.Sleep(time.Millisecond * 20) })
+	f := m.Second()
 	go func() {
 		<-f.Notify()
 	}()
-	tn := time.Now()
 	m.Shutdown()
-	dur := time.Since(tn)
-	if dur > time.Second || dur < time.Millisecond*50 {
-		t.Fatalf("timeout time was unexpected:%v", time.Since(tn))
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 4 {
+		t.Fatalf("want callback for 4 stages, got %d", len(got))
 	}
-	if !m.Started() {
-		t.Fatal("got unexpected shutdown signal")
+	if r := got[Stage1]; r.timedOut || r.d < time.Millisecond*20 {
+		t.Errorf("stage 1: want >= 20ms without timeout, got %+v", r)
+	}
+	if r := got[Stage2]; !r.timedOut || r.d < time.Millisecond*50 {
+		t.Errorf("stage 2: want >= 50ms with timeout, got %+v", r)
+	}
+	if r := got[Stage3]; r.timedOut {
+		t.Errorf("stage 3: want no timeout, got %+v", r)
+	}
+	if total < time.Millisecond*70 {
+		t.Errorf("want total >= 70ms, got %v", total)
 	}
 }
 
-func TestTimeoutCallback(t *testing.T) {
-	var gotStage Stage
-	var gotCtx string
-	m := New(WithOnTimeout(func(s Stage, ctx string) {
-		gotStage = s
-		gotCtx = ctx
-	}), WithTimeout(time.Millisecond*2000), WithTimeoutN(Stage1, time.Millisecond*100))
-
+func TestOnComplete(t *testing.T) {
+	type result struct {
+		total time.Duration
+		err   error
+	}
+	got := make(chan result, 2)
+	m := New(WithOnComplete(func(total time.Duration, err error) {
+		got <- result{total: total, err: err}
+	}), WithTimeout(time.Second), WithTimeoutN(Stage2, 20*time.Millisecond), WithLogger(nil))
 	defer close(startTimer(m, t))
-
-	const testctx = "lock context"
-	f := m.First(testctx)
+	_ = m.FirstFn(func() { panic("expected") })
+	f := m.Second()
 	go func() {
 		<-f.Notify()
 	}()
-	tn := time.Now()
 	m.Shutdown()
-	dur := time.Since(tn)
-	if dur > time.Second || dur < time.Millisecond*50 {
-		t.Errorf("timeout time was unexpected:%v (%v->%v)", dur, tn, time.Now())
-	}
-	if !m.Started() {
-		t.Fatal("got unexpected shutdown signal")
-	}
-	if gotStage != Stage1 {
-		t.Errorf("want stage 1, got %+v", gotStage)
+	m.Shutdown()
+
+	select {
+	case r := <-got:
+		if r.total < 20*time.Millisecond {
+			t.Errorf("want total >= 20ms, got %v", r.total)
+		}
+		if r.err == nil || !strings.Contains(r.err.Error(), "expected") {
+			t.Errorf("want the panic as error, got %v", r.err)
+		}
+	default:
+		t.Fatal("complete callback was not called before Shutdown returned")
 	}
-	if !strings.Contains(gotCtx, testctx) {
-		t.Errorf("want context to contain %q, got %q", testctx, gotCtx)
+	if len(got) != 0 {
+		t.Error("complete callback was called more than once")
 	}
 }
 
@@ -620,6 +1853,66 @@ func TestRecursive(t *testing.T) {
 	}
 }
 
+func TestReentrant(t *testing.T) {
+	// No stage may time out, so a blocked call fails the test.
+	var m *Manager
+	var stages []Stage
+	m = New(WithTimeout(time.Minute), WithLogger(nil), WithOnStageComplete(func(s Stage, d time.Duration, timedOut bool) {
+		stages = append(stages, s)
+		// Called on the goroutine running the shutdown.
+		m.Shutdown()
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.OnBeforeShutdown(func() { m.Shutdown() })
+		m.FirstFn(func() {
+			m.Shutdown()
+			m.Wait()
+		})
+		m.SecondFn(func() { m.ShutdownWith("again") })
+		m.Shutdown()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("re-entrant Shutdown or Wait blocked")
+	}
+	if len(stages) != 4 {
+		t.Errorf("want 4 stages completed, got %d", len(stages))
+	}
+	if r := m.ShutdownReason(); r != "" {
+		t.Errorf("reentrant call should not change the reason, got %q", r)
+	}
+}
+
+func TestReentrantOtherManager(t *testing.T) {
+	a := New(WithTimeout(5*time.Second), WithLogger(nil))
+	b := New(WithTimeout(5*time.Second), WithLogger(nil))
+	defer close(startTimer(a, t))
+	release := make(chan struct{})
+	b.FirstFn(func() { <-release })
+	go b.Shutdown()
+	for !b.Started() {
+		time.Sleep(time.Millisecond)
+	}
+	var finished bool
+	a.FirstFn(func() {
+		time.AfterFunc(50*time.Millisecond, func() { close(release) })
+		// b is independent, so the call waits for its shutdown.
+		b.Wait()
+		select {
+		case <-b.CompletedCh():
+			finished = true
+		default:
+		}
+	})
+	a.Shutdown()
+	if !finished {
+		t.Error("Wait on another manager returned before its shutdown finished")
+	}
+}
+
 func TestBasicFn(t *testing.T) {
 	m := newTestTimer()
 	defer close(startTimer(m, t))
@@ -643,6 +1936,33 @@ func setBool(i *bool) func() {
 	}
 }
 
+func TestCtxFn(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage2, time.Millisecond*20))
+	defer close(startTimer(m, t))
+
+	var err1 error
+	var err2 = make(chan error, 1)
+	_ = m.FirstCtxFn(func(ctx context.Context) {
+		err1 = ctx.Err()
+	})
+	_ = m.SecondCtxFn(func(ctx context.Context) {
+		<-ctx.Done()
+		// The stage may have moved on before this is sent.
+		err2 <- ctx.Err()
+	})
+	tn := time.Now()
+	m.Shutdown()
+	if dur := time.Since(tn); dur > time.Millisecond*500 {
+		t.Fatalf("timeout time was unexpected:%v", dur)
+	}
+	if err1 != nil {
+		t.Errorf("stage 1: want no error, got %v", err1)
+	}
+	if err := <-err2; err != context.DeadlineExceeded {
+		t.Errorf("stage 2: want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
 func TestFnOrder(t *testing.T) {
 	m := newTestTimer()
 	defer close(startTimer(m, t))
@@ -845,6 +2165,37 @@ func TestFnNotify(t *testing.T) {
 	}
 }
 
+func TestNotifyRange(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	fn := m.FirstFn(func() {})
+	n := m.First()
+	second := make(chan bool, 1)
+	go func() {
+		v := <-n.Notify()
+		close(v)
+		// The channel of a notifier is left open after the notification.
+		select {
+		case <-n.Notify():
+			second <- true
+		case <-time.After(10 * time.Millisecond):
+			second <- false
+		}
+	}()
+	m.Shutdown()
+
+	var got int
+	for range fn.Notify() {
+		got++
+	}
+	if got != 1 {
+		t.Fatalf("want 1 notification, got %d", got)
+	}
+	if <-second {
+		t.Fatal("notifier channel was selected after the notification")
+	}
+}
+
 func TestStatusTimerFn(t *testing.T) {
 	version := strings.Split(runtime.Version(), ".")
 	if len(version) >= 2 {
@@ -1041,6 +2392,73 @@ func TestCancelMulti2(t *testing.T) {
 	m.Shutdown()
 }
 
+// TestSlowNotify checks that notifiers that are read late still get exactly one notification,
+// also when the stage has timed out before they are read.
+func TestSlowNotify(t *testing.T) {
+	m := New(WithTimeout(10*time.Millisecond), WithLogger(nil))
+	rand.Seed(0xC0CAC01A)
+	var wg sync.WaitGroup
+	var got atomic.Int32
+	const n = 500
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		var f Notifier
+		switch rand.Int31n(8) {
+		case 0:
+			f = m.PreShutdown()
+		case 1:
+			f = m.First()
+		case 2:
+			f = m.Second()
+		case 3:
+			f = m.Third()
+		case 4:
+			f = m.PreShutdownFn(func() {})
+		case 5:
+			f = m.FirstFn(func() {})
+		case 6:
+			f = m.SecondFn(func() {})
+		case 7:
+			f = m.ThirdFn(func() {})
+		}
+		go func(f Notifier, sleep time.Duration) {
+			defer wg.Done()
+			time.Sleep(sleep)
+			v, ok := <-f.Notify()
+			if !ok {
+				t.Errorf("notification lost on %+v", f)
+				return
+			}
+			got.Add(1)
+			close(v)
+			select {
+			case v, ok := <-f.Notify():
+				if ok {
+					t.Errorf("second notification on %+v", f)
+					close(v)
+				}
+			default:
+			}
+		}(f, time.Duration(rand.Intn(30))*time.Millisecond)
+	}
+	// The stages time out on purpose, so startTimer leaves too little room.
+	// Readers may still be sleeping after shutdown has finished.
+	done := make(chan struct{})
+	go func() {
+		m.Shutdown()
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("shutdown or readers did not finish")
+	}
+	if got.Load() != n {
+		t.Errorf("want %d notifications, got %d", n, got.Load())
+	}
+}
+
 func TestCancelWaitMulti(t *testing.T) {
 	m := New(WithTimeout(time.Millisecond * 400))
 
@@ -1129,6 +2547,123 @@ func TestCancelWaitMulti2(t *testing.T) {
 	m.Shutdown()
 }
 
+func TestCancelRemoves(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	before := runtime.NumGoroutine()
+
+	var ns []Notifier
+	for i := 0; i < 1000; i++ {
+		ns = append(ns, m.First(), m.FirstFn(func() {}))
+	}
+	keep := m.First()
+	m.sqM.Lock()
+	if got := len(m.shutdownQueue[1]); got != 2001 {
+		t.Fatalf("want 2001 queued notifiers, got %d", got)
+	}
+	m.sqM.Unlock()
+	for _, n := range ns {
+		n.Cancel()
+	}
+
+	m.sqM.Lock()
+	queue, fns := m.shutdownQueue[1], m.shutdownFnQueue[1]
+	m.sqM.Unlock()
+	if len(queue) != 1 || queue[0].n.c != keep.c || len(fns) != 0 {
+		t.Fatalf("want only the kept notifier queued, got %d notifiers and %d functions", len(queue), len(fns))
+	}
+	if cap(queue) > 4 || cap(fns) > 4 {
+		t.Errorf("queues not shrunk, capacity %d and %d", cap(queue), cap(fns))
+	}
+	// The goroutines of the cancelled functions exit.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before+10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before+10 {
+		t.Errorf("goroutines leaked, %d before and %d after", before, got)
+	}
+}
+
+func TestCancelAll(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var called atomic.Int32
+	m.PreShutdownFn(func() { called.Add(1) })
+	m.FirstFn(func() { called.Add(1) })
+	m.ThirdCtxFn(func(context.Context) { called.Add(1) })
+	notifiers := []Notifier{m.PreShutdown(), m.First(), m.Second(), m.Third()}
+	m.CancelAll()
+
+	// The manager must still accept new notifiers.
+	var after atomic.Bool
+	m.SecondFn(func() { after.Store(true) })
+	m.Shutdown()
+
+	if n := called.Load(); n != 0 {
+		t.Errorf("want no calls to cancelled functions, got %d", n)
+	}
+	if !after.Load() {
+		t.Error("function registered after CancelAll was not called")
+	}
+	for _, n := range notifiers {
+		select {
+		case <-n.Notify():
+			t.Errorf("cancelled notifier was notified: %+v", n)
+		default:
+		}
+	}
+}
+
+func TestCancelAllDuringShutdown(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var third atomic.Bool
+	m.ThirdFn(func() { third.Store(true) })
+	f := m.First()
+	go func() {
+		v := <-f.Notify()
+		m.CancelAll()
+		close(v)
+	}()
+	var second atomic.Bool
+	m.SecondFn(func() { second.Store(true) })
+	m.Shutdown()
+
+	if second.Load() || third.Load() {
+		t.Errorf("stages after CancelAll should not be called, second: %v, third: %v", second.Load(), third.Load())
+	}
+}
+
+func TestCancelAllDuringShutdownNotify(t *testing.T) {
+	m := New(WithTimeout(5 * time.Second))
+	defer close(startTimer(m, t))
+
+	// A reader blocked on Notify still gets the notification, like with Cancel.
+	third := m.Third()
+	got := make(chan struct{})
+	go func() {
+		v := <-third.Notify()
+		close(v)
+		close(got)
+	}()
+	// An unread notification does not make the stage wait.
+	m.Second()
+	m.FirstFn(func() { m.CancelAll() })
+	start := time.Now()
+	m.Shutdown()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown took %v, want the cancelled notifiers not to be waited for", d)
+	}
+	select {
+	case <-got:
+	case <-time.After(time.Second):
+		t.Fatal("reader of a cancelled notifier was not notified")
+	}
+}
+
 /*
 // Get a notifier and perform our own code when we shutdown
 func ExampleNotifier() {
@@ -1222,3 +2757,31 @@ m := NewTestTimer()
 	// exiting main
 }
 */
+
+func TestStageNames(t *testing.T) {
+	for s, want := range map[Stage]string{StagePS: "PreShutdown", Stage1: "First", Stage2: "Second", Stage3: "Third"} {
+		if got := fmt.Sprint(s); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+
+	var rec eventRecorder
+	m := New(WithStageNames("drain", "http", ""), WithTimeout(time.Second), WithLogger(rec.log))
+	defer close(startTimer(m, t))
+	for s, want := range map[Stage]string{StagePS: "drain", Stage1: "http", Stage2: "Second", Stage3: "Third"} {
+		if got := m.StageName(s); got != want {
+			t.Errorf("want %q, got %q", want, got)
+		}
+	}
+	m.FirstFn(func() {})
+	m.Shutdown()
+	var found bool
+	for _, e := range rec.get() {
+		if e.Kind == EventStageCompleted && e.Message == "Shutdown stage 1 (http) completed" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("stage name not logged, got %v", rec.get())
+	}
+}
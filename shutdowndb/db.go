@@ -0,0 +1,96 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+// Package shutdowndb closes a database/sql.DB, or a similar connection pool, in a shutdown stage.
+//
+// It is a separate package, so database/sql is only
+// a dependency if you import this package.
+//
+//	db, err := sql.Open("postgres", dsn)
+//	...
+//	shutdowndb.ManageDB(m, db, shutdown.Stage2, true)
+package shutdowndb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/eikmadsen/shutdown"
+)
+
+// DB is a connection pool that can be closed.
+// It is implemented by *sql.DB.
+type DB interface {
+	Stats() sql.DBStats
+	Close() error
+}
+
+// pollInterval is how often the connections in use are checked while draining.
+var pollInterval = 50 * time.Millisecond
+
+// ManageDB closes db in stage s.
+// If drain is true, the stage first waits for the connections in use to be returned to the pool,
+// no longer than the timeout of the stage. sql.DB has no way to close with a context,
+// so the connections in use are polled with db.Stats.
+// Polling and the timeout follow the clock of the manager, see shutdown.WithClock.
+// While draining, the number of connections in use is reported as the progress of the notifier,
+// and is logged by the status timer, see shutdown.WithStatusTimer.
+// The error returned by Close is ignored.
+// If stage s has already started, db is not closed, and an invalid notifier is returned.
+func ManageDB(m *shutdown.Manager, db DB, s shutdown.Stage, drain bool) shutdown.Notifier {
+	// The notifier is only known when it has been registered, which may race with shutdown.
+	var mu sync.Mutex
+	var n shutdown.Notifier
+	mu.Lock()
+	defer mu.Unlock()
+	n = register(m, s, func(ctx context.Context) {
+		if drain {
+			mu.Lock()
+			n := n
+			mu.Unlock()
+			wait(ctx, m.Clock(), db, n)
+		}
+		_ = db.Close()
+	})
+	return n
+}
+
+// wait waits for the connections in use in db to be returned, or ctx to be done.
+// The connections are polled every pollInterval according to c.
+// ctx is cancelled by the manager when the timeout of the stage expires on the same clock.
+func wait(ctx context.Context, c shutdown.Clock, db DB, n shutdown.Notifier) {
+	start := db.Stats().InUse
+	for {
+		inUse := db.Stats().InUse
+		if inUse == 0 {
+			return
+		}
+		if inUse > start {
+			start = inUse
+		}
+		n.Progress(1-float64(inUse)/float64(start), fmt.Sprintf("draining database, %d connections in use", inUse))
+		t := c.NewTimer(pollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C():
+		}
+	}
+}
+
+// register executes fn in stage s.
+func register(m *shutdown.Manager, s shutdown.Stage, fn func(ctx context.Context)) shutdown.Notifier {
+	switch s {
+	case shutdown.StagePS:
+		return m.PreShutdownCtxFn(fn, "database")
+	case shutdown.Stage1:
+		return m.FirstCtxFn(fn, "database")
+	case shutdown.Stage2:
+		return m.SecondCtxFn(fn, "database")
+	default:
+		return m.ThirdCtxFn(fn, "database")
+	}
+}
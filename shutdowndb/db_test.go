@@ -0,0 +1,151 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdowndb
+
+import (
+	"database/sql"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eikmadsen/shutdown"
+)
+
+type fakeDB struct {
+	inUse  atomic.Int32
+	closed atomic.Int32
+	polls  atomic.Int32
+}
+
+func (f *fakeDB) Stats() sql.DBStats {
+	f.polls.Add(1)
+	return sql.DBStats{InUse: int(f.inUse.Load())}
+}
+
+func (f *fakeDB) Close() error {
+	f.closed.Add(1)
+	return nil
+}
+
+func TestManageDB(t *testing.T) {
+	pollInterval = time.Millisecond
+	var mu sync.Mutex
+	var events []shutdown.Event
+	m := shutdown.New(shutdown.WithTimeout(time.Second), shutdown.WithOSExit(false), shutdown.WithStatusTimer(5*time.Millisecond),
+		shutdown.WithLogger(func(e shutdown.Event) {
+			mu.Lock()
+			events = append(events, e)
+			mu.Unlock()
+		}))
+	db := &fakeDB{}
+	db.inUse.Store(2)
+	ManageDB(m, db, shutdown.Stage2, true)
+	var closedEarly int32
+	m.FirstFn(func() {
+		closedEarly = db.closed.Load()
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			db.inUse.Store(0)
+		}()
+	})
+	m.Shutdown()
+	if closedEarly != 0 {
+		t.Error("database closed before stage 2")
+	}
+	if db.closed.Load() != 1 {
+		t.Error("database not closed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	var found bool
+	for _, e := range events {
+		found = found || strings.Contains(e.Message, "2 connections in use")
+	}
+	if !found {
+		t.Errorf("connection count not logged, got %+v", events)
+	}
+}
+
+func TestManageDBTimeout(t *testing.T) {
+	pollInterval = time.Millisecond
+	m := shutdown.New(shutdown.WithTimeout(time.Second), shutdown.WithTimeoutN(shutdown.Stage1, 20*time.Millisecond), shutdown.WithOSExit(false))
+	db := &fakeDB{}
+	db.inUse.Store(1)
+	ManageDB(m, db, shutdown.Stage1, true)
+	m.Shutdown()
+	// The stage has timed out, but the function still closes the database.
+	deadline := time.Now().Add(time.Second)
+	for db.closed.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if db.closed.Load() != 1 {
+		t.Error("database not closed after the stage timed out")
+	}
+}
+
+// advanceUntilClosed advances c by step until db is closed, or a second has passed.
+func advanceUntilClosed(c *shutdown.ManualClock, db *fakeDB, step time.Duration) {
+	deadline := time.Now().Add(time.Second)
+	for db.closed.Load() == 0 && time.Now().Before(deadline) {
+		c.Advance(step)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestManageDBClock(t *testing.T) {
+	// The poll interval is too long for the test unless it follows the manual clock.
+	pollInterval = time.Minute
+	start := time.Now()
+	c := shutdown.NewManualClock(start)
+	m := shutdown.New(shutdown.WithClock(c), shutdown.WithTimeout(24*time.Hour), shutdown.WithOSExit(false), shutdown.WithLogger(nil))
+	db := &fakeDB{}
+	db.inUse.Store(1)
+	ManageDB(m, db, shutdown.Stage1, true)
+	go m.Shutdown()
+	for db.polls.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	db.inUse.Store(0)
+	advanceUntilClosed(c, db, pollInterval)
+	if db.closed.Load() != 1 {
+		t.Fatal("database not closed")
+	}
+	if d := c.Now().Sub(start); d >= 24*time.Hour {
+		t.Errorf("database closed after the stage timed out, after %v", d)
+	}
+	m.Wait()
+}
+
+func TestManageDBClockTimeout(t *testing.T) {
+	pollInterval = time.Hour
+	start := time.Now()
+	c := shutdown.NewManualClock(start)
+	m := shutdown.New(shutdown.WithClock(c), shutdown.WithTimeout(time.Hour), shutdown.WithTimeoutN(shutdown.Stage1, time.Minute),
+		shutdown.WithOSExit(false), shutdown.WithLogger(nil))
+	db := &fakeDB{}
+	db.inUse.Store(1)
+	ManageDB(m, db, shutdown.Stage1, true)
+	go m.Shutdown()
+	advanceUntilClosed(c, db, time.Second)
+	if db.closed.Load() != 1 {
+		t.Fatal("database not closed after the stage timed out")
+	}
+	if d := c.Now().Sub(start); d < time.Minute || d >= pollInterval {
+		t.Errorf("want database closed when the stage timed out, got %v", d)
+	}
+	m.Wait()
+}
+
+func TestManageDBStarted(t *testing.T) {
+	m := shutdown.New(shutdown.WithTimeout(time.Second), shutdown.WithOSExit(false))
+	m.Shutdown()
+	db := &fakeDB{}
+	if n := ManageDB(m, db, shutdown.Stage1, false); n.Valid() {
+		t.Error("notifier should be invalid after shutdown")
+	}
+	if db.closed.Load() != 0 {
+		t.Error("database closed after shutdown")
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/eikmadsen/shutdown/shutdownerrgroup
+
+go 1.20
+
+require (
+	github.com/eikmadsen/shutdown v0.0.0-20261015105100-0a8a3aeb11f3
+	golang.org/x/sync v0.8.0
+)
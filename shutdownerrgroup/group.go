@@ -0,0 +1,52 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+// Package shutdownerrgroup ties the workers of an errgroup.Group to a shutdown stage.
+//
+// It is a separate module, so golang.org/x/sync is only
+// a dependency if you import this package.
+//
+//	g, ctx := shutdownerrgroup.GoGroup(m, shutdown.Stage1)
+//	for i := 0; i < workers; i++ {
+//		g.Go(func() error { return work(ctx) })
+//	}
+package shutdownerrgroup
+
+import (
+	"context"
+
+	"github.com/eikmadsen/shutdown"
+	"golang.org/x/sync/errgroup"
+)
+
+// GoGroup returns a group whose context is cancelled in stage s.
+// The stage waits for all functions started with Go to return,
+// no longer than the timeout of the stage.
+// The context is also cancelled when a function in the group returns an error,
+// like errgroup.WithContext.
+// If stage s has already started, the context is cancelled at once.
+func GoGroup(m *shutdown.Manager, s shutdown.Stage) (*errgroup.Group, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g, ctx := errgroup.WithContext(ctx)
+	n := register(m, s, func(context.Context) {
+		cancel()
+		_ = g.Wait()
+	})
+	if !n.Valid() {
+		cancel()
+	}
+	return g, ctx
+}
+
+// register executes fn in stage s.
+func register(m *shutdown.Manager, s shutdown.Stage, fn func(ctx context.Context)) shutdown.Notifier {
+	switch s {
+	case shutdown.StagePS:
+		return m.PreShutdownCtxFn(fn, "errgroup")
+	case shutdown.Stage1:
+		return m.FirstCtxFn(fn, "errgroup")
+	case shutdown.Stage2:
+		return m.SecondCtxFn(fn, "errgroup")
+	default:
+		return m.ThirdCtxFn(fn, "errgroup")
+	}
+}
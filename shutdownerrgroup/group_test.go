@@ -0,0 +1,48 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdownerrgroup
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eikmadsen/shutdown"
+)
+
+func TestGoGroup(t *testing.T) {
+	m := shutdown.New(shutdown.WithTimeout(time.Second), shutdown.WithOSExit(false))
+	g, ctx := GoGroup(m, shutdown.Stage2)
+	var stopped atomic.Int32
+	for i := 0; i < 4; i++ {
+		g.Go(func() error {
+			<-ctx.Done()
+			time.Sleep(10 * time.Millisecond)
+			stopped.Add(1)
+			return nil
+		})
+	}
+	var early atomic.Bool
+	m.FirstFn(func() { early.Store(ctx.Err() != nil) })
+	var after int32
+	m.ThirdFn(func() { after = stopped.Load() })
+	m.Shutdown()
+	if early.Load() {
+		t.Error("context cancelled before stage 2")
+	}
+	if after != 4 {
+		t.Errorf("want 4 workers stopped before stage 3, got %d", after)
+	}
+}
+
+func TestGoGroupStarted(t *testing.T) {
+	m := shutdown.New(shutdown.WithTimeout(time.Second), shutdown.WithOSExit(false))
+	m.Shutdown()
+	g, ctx := GoGroup(m, shutdown.Stage1)
+	if ctx.Err() == nil {
+		t.Error("context should be cancelled after the stage has started")
+	}
+	if err := g.Wait(); err != nil {
+		t.Error(err)
+	}
+}
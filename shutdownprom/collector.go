@@ -0,0 +1,101 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+// Package shutdownprom exposes shutdown metrics to Prometheus.
+//
+// It is a separate module, so the Prometheus client is only
+// a dependency if you import this package.
+//
+// The collector is fed from the events of the manager:
+//
+//	c := shutdownprom.NewCollector("myapp")
+//	prometheus.MustRegister(c)
+//	m := shutdown.New(c.Option())
+package shutdownprom
+
+import (
+	"strconv"
+
+	"github.com/eikmadsen/shutdown"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects shutdown metrics from manager events.
+// It implements prometheus.Collector.
+type Collector struct {
+	started       prometheus.Counter
+	stageTimeouts *prometheus.CounterVec
+	panics        prometheus.Counter
+	stageDuration *prometheus.HistogramVec
+}
+
+// NewCollector returns a new collector.
+// All metrics are prefixed with the namespace, if not empty.
+func NewCollector(namespace string) *Collector {
+	return &Collector{
+		started: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "shutdown",
+			Name:      "started_total",
+			Help:      "Number of shutdowns started.",
+		}),
+		stageTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "shutdown",
+			Name:      "stage_timeouts_total",
+			Help:      "Number of shutdown stages that timed out.",
+		}, []string{"stage"}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "shutdown",
+			Name:      "panics_recovered_total",
+			Help:      "Number of panics recovered in shutdown functions.",
+		}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "shutdown",
+			Name:      "stage_duration_seconds",
+			Help:      "Duration of shutdown stages.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"stage"}),
+	}
+}
+
+// Option returns an option that feeds the collector with events from a manager.
+// The same collector can be used with several managers.
+func (c *Collector) Option() shutdown.Option {
+	return shutdown.WithEventHook(c.Observe)
+}
+
+// Observe updates the metrics from a single event.
+func (c *Collector) Observe(e shutdown.Event) {
+	switch e.Kind {
+	case shutdown.EventShutdownStarted:
+		c.started.Inc()
+	case shutdown.EventStageTimeout:
+		c.stageTimeouts.WithLabelValues(stageLabel(e.Stage)).Inc()
+	case shutdown.EventPanic:
+		c.panics.Inc()
+	case shutdown.EventStageCompleted:
+		c.stageDuration.WithLabelValues(stageLabel(e.Stage)).Observe(e.Duration.Seconds())
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.started.Describe(ch)
+	c.stageTimeouts.Describe(ch)
+	c.panics.Describe(ch)
+	c.stageDuration.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.started.Collect(ch)
+	c.stageTimeouts.Collect(ch)
+	c.panics.Collect(ch)
+	c.stageDuration.Collect(ch)
+}
+
+func stageLabel(s shutdown.Stage) string {
+	return strconv.Itoa(s.Index())
+}
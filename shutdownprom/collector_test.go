@@ -0,0 +1,40 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdownprom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eikmadsen/shutdown"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector("test")
+	reg := prometheus.NewPedanticRegistry()
+	if err := reg.Register(c); err != nil {
+		t.Fatal(err)
+	}
+	m := shutdown.New(c.Option(), shutdown.WithTimeout(time.Second), shutdown.WithTimeoutN(shutdown.Stage2, 10*time.Millisecond))
+	_ = m.FirstFn(func() { panic("expected") })
+	f := m.Second()
+	go func() {
+		<-f.Notify()
+	}()
+	m.Shutdown()
+
+	if got := testutil.ToFloat64(c.started); got != 1 {
+		t.Errorf("want 1 shutdown started, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.panics); got != 1 {
+		t.Errorf("want 1 panic, got %v", got)
+	}
+	if got := testutil.ToFloat64(c.stageTimeouts.WithLabelValues("2")); got != 1 {
+		t.Errorf("want 1 timeout in stage 2, got %v", got)
+	}
+	if got := testutil.CollectAndCount(c.stageDuration); got != 3 {
+		t.Errorf("want durations for 3 stages, got %v", got)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build go1.21
+
+package shutdown
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// WithSlog sends all events to l as structured records.
+// The stage, notifier context, duration, shutdown reason and progress are added as the attributes
+// "stage", "context", "duration", "reason" and "progress" when they are set on the event,
+// and the labels of the notifier, see WithLabels, as the group "labels".
+// If l is nil the option does nothing.
+func WithSlog(l *slog.Logger) Option {
+	if l == nil {
+		return func(*Manager) {}
+	}
+	return loggerOption(func(*Manager) func(Event) {
+		return func(e Event) {
+			attrs := []slog.Attr{slog.Int("stage", e.Stage.n)}
+			if e.Context != "" {
+				attrs = append(attrs, slog.String("context", e.Context))
+			}
+			if e.Duration != 0 {
+				attrs = append(attrs, slog.Duration("duration", e.Duration))
+			}
+			if e.Reason != "" {
+				attrs = append(attrs, slog.String("reason", e.Reason))
+			}
+			if e.Progress != 0 {
+				attrs = append(attrs, slog.Float64("progress", e.Progress))
+			}
+			if labels := e.Labels(); len(labels) != 0 {
+				keys := make([]string, 0, len(labels))
+				for k := range labels {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				group := make([]slog.Attr, len(keys))
+				for i, k := range keys {
+					group[i] = slog.String(k, labels[k])
+				}
+				attrs = append(attrs, slog.Attr{Key: "labels", Value: slog.GroupValue(group...)})
+			}
+			l.LogAttrs(context.Background(), slogLevel(e.Level), e.Message, attrs...)
+		}
+	})
+}
+
+// SetSlog replaces the logger with l, like WithSlog.
+// It can be called at any time, see SetLogPrinter.
+func (m *Manager) SetSlog(l *slog.Logger) {
+	m.setLogger(WithSlog(l))
+}
+
+// slogLevel converts a Level to the matching slog level.
+func slogLevel(l Level) slog.Level {
+	switch l {
+	case LevelWarn:
+		return slog.LevelWarn
+	case LevelError:
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
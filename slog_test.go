@@ -0,0 +1,79 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+//go:build go1.21
+
+package shutdown
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordHandler is a slog.Handler that keeps all records.
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	h.records = append(h.records, r.Clone())
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordHandler) WithGroup(string) slog.Handler { return h }
+
+func TestSlog(t *testing.T) {
+	h := &recordHandler{}
+	m := New(WithSlog(slog.New(h)), WithTimeout(time.Millisecond*50))
+	defer close(startTimer(m, t))
+
+	const testctx = "slog context"
+	f := m.First(testctx)
+	go func() {
+		<-f.Notify()
+	}()
+	m.Shutdown()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found bool
+	for _, r := range h.records {
+		attrs := map[string]slog.Value{}
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value
+			return true
+		})
+		if r.Level != slog.LevelError || !strings.Contains(attrs["context"].String(), testctx) {
+			continue
+		}
+		found = true
+		if got := attrs["stage"].Int64(); got != 1 {
+			t.Errorf("want stage 1, got %d", got)
+		}
+		if got := attrs["duration"].Duration(); got < time.Millisecond*50 {
+			t.Errorf("want duration >= 50ms, got %v", got)
+		}
+	}
+	if !found {
+		t.Fatalf("no error record with context %q", testctx)
+	}
+}
+
+func TestSlogNil(t *testing.T) {
+	var buf = &logBuffer{fn: t.Logf}
+	m := New(WithLogPrinter(buf.WriteF), WithSlog(nil))
+	m.log(Event{Message: "still logged"})
+	if !strings.Contains(buf.buf.String(), "still logged") {
+		t.Errorf("nil slog logger should keep the existing logger, got %q", buf.buf.String())
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// StageMode controls how notifiers within a stage are notified.
+type StageMode int
+
+const (
+	// ParallelMode notifies all notifiers in the stage at once. This is the default.
+	ParallelMode StageMode = iota
+
+	// SequentialMode notifies the notifiers in the stage one at the time in the order they were registered.
+	// The next notifier is notified when the previous has finished.
+	// The stage timeout applies to the whole stage.
+	SequentialMode
+)
+
+// TimeoutPolicy controls what happens when a stage times out.
+type TimeoutPolicy int
+
+const (
+	// Advance stops waiting for the notifiers of the stage and advances to the next stage
+	// when the stage times out. This is the default.
+	Advance TimeoutPolicy = iota
+
+	// KeepWaiting keeps waiting for the notifiers of the stage until they have finished
+	// or the hard deadline is reached. Each time the stage timeout elapses the timeout is
+	// reported as when the stage times out, but the stage is not left.
+	// Functions registered with a context get a context that is cancelled at the hard deadline.
+	// KeepWaiting requires a hard deadline, see WithHardDeadline. Without one the stage advances.
+	KeepWaiting
+)
+
+// runStage notifies all notifiers in a stage and waits for them to finish,
+// no longer than the timeout of the stage.
+// Returns true if the stage timed out.
+func (m *Manager) runStage(stage int) (timedOut bool) {
+	m.sqM.Lock()
+	m.srM.Lock()
+	m.currentStage = Stage{stage}
+	d := m.stageTimeout(stage)
+	wait := d
+	keepWaiting := m.timeoutPolicies[stage] == KeepWaiting && !m.deadline.IsZero()
+	if keepWaiting {
+		wait = m.capDeadline(m.deadline.Sub(m.clock.Now()))
+		keepWaiting = d < wait
+	}
+	m.stageDeadline = time.Time{}
+	if wait > 0 {
+		m.stageDeadline = m.clock.Now().Add(wait)
+	}
+	m.srM.Unlock()
+	for _, c := range m.transitions {
+		select {
+		case c <- Stage{stage}:
+		default:
+			// The consumer is behind, don't delay the shutdown.
+		}
+	}
+
+	queue := append([]iNotifier(nil), m.shutdownQueue[stage]...)
+	if len(queue) == 0 {
+		m.sqM.Unlock()
+		return false
+	}
+
+	m.stagesRun++
+	if m.stagesRun == 1 {
+		m.log(Event{Kind: EventShutdownStarted, Stage: Stage{stage}, Context: m.ShutdownReason(), Message: fmt.Sprintf("Initiating shutdown %v", m.clock.Now())})
+	} else {
+		m.log(Event{Kind: EventStageStarted, Stage: Stage{stage}, Message: fmt.Sprintf("Shutdown stage %v (%s)", stage, m.StageName(Stage{stage}))})
+	}
+	start := m.clock.Now()
+	defer func() {
+		m.log(Event{Kind: EventStageCompleted, Stage: Stage{stage}, Message: fmt.Sprintf("Shutdown stage %v (%s) completed", stage, m.StageName(Stage{stage})), Duration: m.since(start)})
+	}()
+
+	// Wait for all to return, no more than the shutdown delay.
+	// The context is given to functions registered with a context.
+	ctx, cancel := m.timeoutContext(context.Background(), wait)
+	defer cancel()
+	m.stageCtx[stage] = ctx
+	timeout := ctx.Done()
+
+	done := make([]chan struct{}, len(queue))
+	groups := m.stageGroups(stage, queue)
+	m.shuffleGroups(stage, groups)
+	notify := func(group []int) {
+		for _, i := range group {
+			done[i] = make(chan struct{})
+		}
+		for _, i := range group {
+			deps := groupDeps(queue, group, i)
+			if len(deps) == 0 {
+				queue[i].n.c <- done[i]
+				continue
+			}
+			// Notify when the dependencies have finished, or the stage has timed out.
+			go func(i int, deps []int) {
+				for _, j := range deps {
+					select {
+					case <-done[j]:
+					case <-timeout:
+					}
+				}
+				queue[i].n.c <- done[i]
+			}(i, deps)
+		}
+	}
+
+	// Send notification to the first group
+	notify(groups[0])
+
+	// Send notification to all function notifiers, but don't wait
+	for _, notifier := range m.shutdownFnQueue[stage] {
+		notifier.client.c <- make(chan struct{})
+		close(notifier.client.c)
+	}
+
+	// We don't lock while we are waiting for notifiers to return
+	m.sqM.Unlock()
+
+	var tick <-chan time.Time
+	var ticker Timer
+	if m.logLockTimeouts {
+		ticker = m.clock.NewTimer(m.statusTimer)
+		defer func() { ticker.Stop() }()
+		tick = ticker.C()
+	}
+
+	// With KeepWaiting the stage timeout is reported each time it elapses.
+	var overdue <-chan time.Time
+	var overdueTimer Timer
+	if keepWaiting {
+		overdueTimer = m.clock.NewTimer(d)
+		defer func() { overdueTimer.Stop() }()
+		overdue = overdueTimer.C()
+	}
+
+	notified := start
+	for g, group := range groups {
+		if g > 0 {
+			notified = m.clock.Now()
+			notify(group)
+		}
+		for _, i := range bestEffortLast(queue, group) {
+			var ticks int
+			var beTimeout <-chan time.Time
+			var beTimer Timer
+			if queue[i].bestEffort && m.bestEffortTimeout > 0 {
+				beTimer = m.clock.NewTimer(m.bestEffortTimeout - m.since(notified))
+				beTimeout = beTimer.C()
+			}
+		wloop:
+			for {
+				select {
+				case <-done[i]:
+					break wloop
+				case <-beTimeout:
+					m.bestEffortTimedOut(stage, start, queue[i])
+					break wloop
+				case <-timeout:
+					if queue[i].bestEffort {
+						m.bestEffortTimedOut(stage, start, queue[i])
+						break wloop
+					}
+					m.stageTimedOut(stage, start, queue, done, i)
+					// Notify the remaining notifiers, so they are not left waiting.
+					for _, rest := range groups[g+1:] {
+						notify(rest)
+					}
+					return true
+				case <-tick:
+					ticker = m.clock.NewTimer(m.statusTimer)
+					tick = ticker.C()
+					if m.logLockTimeouts {
+						ticks++
+						m.logWaiting(stage, start, queue[i])
+						m.escalate(stage, start, queue[i], ticks)
+					}
+				case <-overdue:
+					overdueTimer = m.clock.NewTimer(d)
+					overdue = overdueTimer.C()
+					m.stageOverdue(stage, start, queue[i])
+				}
+			}
+			if beTimer != nil {
+				beTimer.Stop()
+			}
+		}
+	}
+	return false
+}
+
+// bestEffortLast returns the notifiers of group with the best effort notifiers last,
+// so the stage waits for the other notifiers first.
+func bestEffortLast(queue []iNotifier, group []int) []int {
+	order := make([]int, 0, len(group))
+	for _, i := range group {
+		if !queue[i].bestEffort {
+			order = append(order, i)
+		}
+	}
+	for _, i := range group {
+		if queue[i].bestEffort {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// bestEffortTimedOut reports that a notifier registered with BestEffort did not finish in time.
+// It is not counted as a timeout.
+func (m *Manager) bestEffortTimedOut(stage int, start time.Time, n iNotifier) {
+	m.log(Event{Kind: EventNotifierTimeout, Level: LevelInfo, Stage: Stage{stage}, Context: n.calledFrom, labels: n.labels, Message: m.withReason("Best effort notifier timed out"), Duration: m.since(start)})
+}
+
+// logWaiting logs that the stage is waiting for notifier n,
+// including the latest progress reported by the notifier.
+func (m *Manager) logWaiting(stage int, start time.Time, n iNotifier) {
+	e := Event{Kind: EventNotifierWaiting, Level: LevelWarn, Stage: Stage{stage}, Context: n.calledFrom, labels: n.labels, Message: fmt.Sprintf("Stage %d, waiting for notifier", stage), Duration: m.since(start)}
+	m.sqM.Lock()
+	p, ok := m.progress[n.n.c]
+	m.sqM.Unlock()
+	if ok {
+		e.Progress = p.fraction
+		e.Message = p.message(stage)
+	}
+	m.logStatus(e)
+}
+
+// message describes the progress of a notifier in stage.
+func (p progress) message(stage int) string {
+	return fmt.Sprintf("Stage %d, %s %.0f%% complete", stage, p.msg, p.fraction*100)
+}
+
+// groupDeps returns the indexes of the notifiers in group that notifier i depends on.
+// Dependencies outside the group have already finished when the group is notified.
+func groupDeps(queue []iNotifier, group []int, i int) []int {
+	var deps []int
+	for _, c := range queue[i].deps {
+		for _, j := range group {
+			if queue[j].n.c == c {
+				deps = append(deps, j)
+			}
+		}
+	}
+	return deps
+}
+
+// shuffleGroups shuffles the order of the notifiers within each group,
+// if enabled with WithIntraStageShuffle. Sequential stages are not shuffled.
+// The caller must hold sqM.
+func (m *Manager) shuffleGroups(stage int, groups [][]int) {
+	if m.shuffle == nil || m.stageModes[stage] == SequentialMode {
+		return
+	}
+	for _, group := range groups {
+		m.shuffle.Shuffle(len(group), func(a, b int) {
+			group[a], group[b] = group[b], group[a]
+		})
+	}
+}
+
+// stageGroups returns the indexes of the notifiers in a stage
+// divided into groups that are notified together.
+// Each group is notified when the previous group has finished.
+// Groups larger than the concurrency limit of the stage are split into batches.
+func (m *Manager) stageGroups(stage int, queue []iNotifier) [][]int {
+	idx := make([]int, len(queue))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(a, b int) bool {
+		return queue[idx[a]].priority < queue[idx[b]].priority
+	})
+	sequential := m.stageModes[stage] == SequentialMode
+	var groups [][]int
+	for k, i := range idx {
+		if sequential || k == 0 || queue[i].priority != queue[idx[k-1]].priority {
+			groups = append(groups, []int{i})
+			continue
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], i)
+	}
+	if n := m.stageConcurrency[stage]; n > 0 {
+		var batches [][]int
+		for _, group := range groups {
+			for len(group) > n {
+				batches = append(batches, group[:n:n])
+				group = group[n:]
+			}
+			batches = append(batches, group)
+		}
+		groups = batches
+	}
+	return groups
+}
+
+// stageTimedOut reports that the stage timed out while waiting for notifier i.
+// wait contains the channels of the notifiers that have been notified.
+func (m *Manager) stageTimedOut(stage int, start time.Time, queue []iNotifier, wait []chan struct{}, i int) {
+	if stage == 0 {
+		m.locksTimedOut()
+	}
+	m.sqM.Lock()
+	for j := range wait {
+		if queue[j].bestEffort {
+			continue
+		}
+		if wait[j] == nil {
+			// Not notified yet, it will not be waited for.
+			m.timedOutCount++
+			continue
+		}
+		select {
+		case <-wait[j]:
+		default:
+			m.timedOutCount++
+		}
+	}
+	m.sqM.Unlock()
+	if m.logLockTimeouts {
+		if m.onTimeOut != nil {
+			m.onTimeOut(Stage{n: stage}, queue[i].calledFrom, m.since(start), m.ShutdownReason())
+		}
+		m.log(Event{Kind: EventNotifierTimeout, Level: LevelError, Stage: Stage{stage}, Context: queue[i].calledFrom, labels: queue[i].labels, Message: m.withReason("Notifier Timed Out"), Duration: m.since(start)})
+		for j := range wait {
+			if wait[j] != nil && queue[j].unserviced() {
+				m.log(Event{Kind: EventNotifierUnserviced, Level: LevelWarn, Stage: Stage{stage}, Context: queue[j].calledFrom, labels: queue[j].labels, Message: fmt.Sprintf("Notifier registered at %s was never serviced", queue[j].calledFrom)})
+			}
+		}
+	}
+	m.log(Event{Kind: EventStageTimeout, Level: LevelError, Stage: Stage{stage}, Message: m.withReason(fmt.Sprintf("Timeout waiting to shutdown, forcing shutdown stage %v (%s).", stage, m.StageName(Stage{stage}))), Duration: m.since(start)})
+	if m.stuckDump != nil {
+		var stuck []string
+		for j := range wait {
+			if wait[j] == nil || queue[j].bestEffort {
+				continue
+			}
+			select {
+			case <-wait[j]:
+			default:
+				stuck = append(stuck, queue[j].calledFrom)
+			}
+		}
+		m.writeStuckDump(Stage{stage}, stuck)
+	}
+}
+
+// stageOverdue reports that the stage timeout has elapsed while waiting for notifier n,
+// when the stage keeps waiting until the hard deadline.
+func (m *Manager) stageOverdue(stage int, start time.Time, n iNotifier) {
+	if m.logLockTimeouts && m.onTimeOut != nil {
+		m.onTimeOut(Stage{n: stage}, n.calledFrom, m.since(start), m.ShutdownReason())
+	}
+	m.log(Event{Kind: EventNotifierTimeout, Level: LevelWarn, Stage: Stage{stage}, Context: n.calledFrom, labels: n.labels, Message: m.withReason(fmt.Sprintf("Stage %d timed out, waiting for notifier until the shutdown deadline", stage)), Duration: m.since(start)})
+}
+
+// skipStages reports that the stages from stage and onwards are skipped
+// because the shutdown deadline has passed.
+// The notifiers in the skipped stages are not notified.
+func (m *Manager) skipStages(stage int) {
+	m.sqM.Lock()
+	var skipped [][]string
+	for _, queue := range m.shutdownQueue[stage:] {
+		ctxs := make([]string, len(queue))
+		for i, n := range queue {
+			ctxs[i] = n.calledFrom
+		}
+		skipped = append(skipped, ctxs)
+	}
+	m.sqM.Unlock()
+
+	for i, ctxs := range skipped {
+		s := Stage{n: stage + i}
+		if len(ctxs) == 0 {
+			continue
+		}
+		m.log(Event{Kind: EventStageTimeout, Level: LevelError, Stage: s, Message: m.withReason(fmt.Sprintf("Shutdown deadline reached, skipping shutdown stage %v (%s).", s.n, m.StageName(s)))})
+		if m.logLockTimeouts && m.onTimeOut != nil {
+			for _, ctx := range ctxs {
+				m.onTimeOut(s, ctx, 0, m.ShutdownReason())
+			}
+		}
+	}
+}
+
+// unserviced returns true if the notification sent to the notifier
+// is still waiting to be received from its Notify channel.
+func (n iNotifier) unserviced() bool {
+	return len(n.n.c) > 0
+}
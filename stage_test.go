@@ -0,0 +1,649 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSequentialMode(t *testing.T) {
+	m := New(WithStageMode(Stage1, SequentialMode), WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var mu sync.Mutex
+	var order []int
+	var running, maxRunning int32
+	for i := 0; i < 5; i++ {
+		i := i
+		_ = m.FirstFn(func() {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			if n > atomic.LoadInt32(&maxRunning) {
+				atomic.StoreInt32(&maxRunning, n)
+			}
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	m.Shutdown()
+
+	if maxRunning != 1 {
+		t.Errorf("want 1 notifier running at the time, got %d", maxRunning)
+	}
+	for i, v := range order {
+		if i != v {
+			t.Fatalf("want registration order, got %v", order)
+		}
+	}
+	if len(order) != 5 {
+		t.Fatalf("want 5 calls, got %v", order)
+	}
+}
+
+func TestSequentialModeTimeout(t *testing.T) {
+	m := New(WithStageMode(Stage1, SequentialMode), WithTimeout(time.Second), WithTimeoutN(Stage1, time.Millisecond*30))
+	defer close(startTimer(m, t))
+
+	// Never finishes
+	f := m.First()
+	go func() {
+		<-f.Notify()
+	}()
+	called := make(chan struct{})
+	_ = m.FirstFn(func() {
+		close(called)
+	})
+
+	tn := time.Now()
+	m.Shutdown()
+	if dur := time.Since(tn); dur > time.Millisecond*500 {
+		t.Fatalf("timeout time was unexpected:%v", dur)
+	}
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("notifier after the timed out notifier was not called")
+	}
+}
+
+func TestPriority(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var mu sync.Mutex
+	var events []string
+	record := func(s string) {
+		mu.Lock()
+		events = append(events, s)
+		mu.Unlock()
+	}
+	// Both priority 0 functions must be running at the same time.
+	var zero sync.WaitGroup
+	zero.Add(2)
+	fn := func(name string, wg *sync.WaitGroup) func() {
+		return func() {
+			record("start " + name)
+			if wg != nil {
+				wg.Done()
+				wg.Wait()
+			}
+			record("end " + name)
+		}
+	}
+	_ = m.FirstFn(fn("high", nil), "high", WithPriority(10))
+	_ = m.FirstFn(fn("zero", &zero), "zero")
+	_ = m.FirstFn(fn("low", nil), WithPriority(-5))
+	_ = m.FirstFn(fn("zero", &zero), WithPriority(0))
+	m.Shutdown()
+
+	want := []string{"start low", "end low", "start zero", "start zero", "end zero", "end zero", "start high", "end high"}
+	if len(events) != len(want) {
+		t.Fatalf("want %v, got %v", want, events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("want %v, got %v", want, events)
+		}
+	}
+}
+
+func TestDependsOn(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var mu sync.Mutex
+	var events []string
+	record := func(s string) {
+		mu.Lock()
+		events = append(events, s)
+		mu.Unlock()
+	}
+	b := m.FirstFn(func() {
+		time.Sleep(10 * time.Millisecond)
+		record("b")
+	})
+	n := m.First()
+	go func() {
+		v := <-n.Notify()
+		record("n")
+		close(v)
+	}()
+	a := m.FirstFn(func() { record("a") }, DependsOn(b, n))
+	if !a.Valid() {
+		t.Fatal("dependent notifier not registered")
+	}
+	m.Shutdown()
+
+	if len(events) != 3 || events[2] != "a" {
+		t.Fatalf("want a last, got %v", events)
+	}
+}
+
+func TestDependsOnInvalid(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	later := m.SecondFn(func() {})
+	if n := m.FirstFn(func() {}, DependsOn(later)); n.Valid() {
+		t.Fatal("dependency on a later stage was registered")
+	}
+	high := m.FirstFn(func() {}, WithPriority(10))
+	if n := m.FirstFn(func() {}, DependsOn(high)); n.Valid() {
+		t.Fatal("dependency on a higher priority was registered")
+	}
+	if n := m.FirstFn(func() {}, DependsOn(newTestTimer().First())); n.Valid() {
+		t.Fatal("dependency on another manager was registered")
+	}
+	earlier := m.FirstFn(func() {})
+	if n := m.SecondFn(func() {}, DependsOn(earlier, high)); !n.Valid() {
+		t.Fatal("dependency on an earlier stage was not registered")
+	}
+	if n := m.FirstFn(func() {}, DependsOn(Notifier{})); !n.Valid() {
+		t.Fatal("an invalid dependency should be ignored")
+	}
+	cancelled := m.SecondFn(func() {})
+	cancelled.Cancel()
+	if n := m.FirstFn(func() {}, DependsOn(cancelled)); !n.Valid() {
+		t.Fatal("a cancelled dependency should be ignored")
+	}
+	m.Shutdown()
+}
+
+func TestIntraStageShuffle(t *testing.T) {
+	order := func(seed int64, mode StageMode) []int {
+		m := New(WithIntraStageShuffle(seed), WithStageMode(Stage1, mode))
+		groups := [][]int{{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}
+		m.shuffleGroups(1, groups)
+		return groups[0]
+	}
+	a, b := order(1, ParallelMode), order(1, ParallelMode)
+	if fmt.Sprint(a) != fmt.Sprint(b) {
+		t.Errorf("same seed gave different orders %v and %v", a, b)
+	}
+	if fmt.Sprint(a) == fmt.Sprint(order(2, ParallelMode)) {
+		t.Errorf("different seeds gave the same order %v", a)
+	}
+	if got := order(1, SequentialMode); fmt.Sprint(got) != "[0 1 2 3 4 5 6 7 8 9]" {
+		t.Errorf("sequential stage was shuffled: %v", got)
+	}
+
+	// Priorities and dependencies still hold.
+	m := New(WithTimeout(time.Second), WithIntraStageShuffle(0xC0CAC01A))
+	defer close(startTimer(m, t))
+	var mu sync.Mutex
+	var events []string
+	record := func(s string) func() {
+		return func() {
+			mu.Lock()
+			events = append(events, s)
+			mu.Unlock()
+		}
+	}
+	first := m.FirstFn(record("first"))
+	for i := 0; i < 10; i++ {
+		_ = m.FirstFn(record("low"))
+		_ = m.FirstFn(record("high"), WithPriority(1))
+	}
+	_ = m.FirstFn(record("after"), DependsOn(first))
+	m.Shutdown()
+
+	var seenFirst, seenHigh bool
+	for _, e := range events {
+		switch e {
+		case "first":
+			seenFirst = true
+		case "after":
+			if !seenFirst {
+				t.Fatalf("dependency not respected: %v", events)
+			}
+		case "low":
+			if seenHigh {
+				t.Fatalf("priority not respected: %v", events)
+			}
+		case "high":
+			seenHigh = true
+		}
+	}
+	if len(events) != 22 {
+		t.Fatalf("want 22 functions called, got %v", events)
+	}
+}
+
+func TestCurrentStage(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	if _, ok := m.CurrentStage(); ok {
+		t.Fatal("shutdown in progress before start")
+	}
+	var got Stage
+	var ok bool
+	_ = m.SecondFn(func() {
+		got, ok = m.CurrentStage()
+	})
+	m.Shutdown()
+	if !ok || got != Stage2 {
+		t.Errorf("want stage 2 in progress, got %+v, %v", got, ok)
+	}
+	if _, ok := m.CurrentStage(); ok {
+		t.Fatal("shutdown in progress after completion")
+	}
+}
+
+func TestTransitions(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithSkipStages(Stage2), WithLogger(nil))
+	defer close(startTimer(m, t))
+	a, b := m.Transitions(), m.Transitions()
+	m.FirstFn(func() {})
+	m.Shutdown()
+
+	for _, c := range []<-chan Stage{a, b} {
+		var got []Stage
+		for s := range c {
+			got = append(got, s)
+		}
+		if fmt.Sprint(got) != "[PreShutdown First Third]" {
+			t.Errorf("want the stages that ran, got %v", got)
+		}
+	}
+	if _, ok := <-m.Transitions(); ok {
+		t.Error("want a closed channel after shutdown")
+	}
+}
+
+func TestStageDeadline(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage2, 200*time.Millisecond), WithTimeoutN(Stage3, 0))
+	defer close(startTimer(m, t))
+	if _, ok := m.StageDeadline(); ok {
+		t.Fatal("stage deadline before start")
+	}
+	var got time.Time
+	var ok, ok3 bool
+	_ = m.SecondFn(func() {
+		got, ok = m.StageDeadline()
+	})
+	_ = m.ThirdFn(func() {
+		_, ok3 = m.StageDeadline()
+	})
+	before := time.Now()
+	m.Shutdown()
+	if !ok {
+		t.Fatal("no stage deadline in stage 2")
+	}
+	if got.Before(before.Add(200*time.Millisecond)) || got.After(time.Now().Add(200*time.Millisecond)) {
+		t.Errorf("want deadline 200ms after stage 2 started, got %v after start", got.Sub(before))
+	}
+	if ok3 {
+		t.Error("stage without a timeout has a deadline")
+	}
+	if _, ok := m.StageDeadline(); ok {
+		t.Fatal("stage deadline after completion")
+	}
+}
+
+func TestStageDone(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+	stages := []Stage{StagePS, Stage1, Stage2, Stage3}
+	for _, s := range stages {
+		if m.StageDone(s) {
+			t.Fatalf("stage %d done before start", s.Index())
+		}
+	}
+	var done []bool
+	_ = m.SecondFn(func() {
+		for _, s := range stages {
+			done = append(done, m.StageDone(s))
+		}
+	})
+	m.Shutdown()
+	want := []bool{true, true, false, false}
+	for i := range want {
+		if done[i] != want[i] {
+			t.Errorf("want %v during stage 2, got %v", want, done)
+			break
+		}
+	}
+	for _, s := range stages {
+		if !m.StageDone(s) {
+			t.Errorf("stage %d not done after shutdown", s.Index())
+		}
+	}
+}
+
+func TestWaitStage(t *testing.T) {
+	m := newTestTimer()
+	defer close(startTimer(m, t))
+
+	var finished atomic.Bool
+	f := m.First()
+	go func() {
+		v := <-f.Notify()
+		time.Sleep(50 * time.Millisecond)
+		finished.Store(true)
+		close(v)
+	}()
+	var second atomic.Bool
+	_ = m.SecondFn(func() {
+		time.Sleep(50 * time.Millisecond)
+		second.Store(true)
+	})
+
+	waited := make(chan bool)
+	go func() {
+		m.WaitStage(Stage1)
+		waited <- finished.Load() && !second.Load()
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := m.WaitStageContext(ctx, Stage1); err != context.DeadlineExceeded {
+		t.Fatalf("want deadline exceeded before shutdown, got %v", err)
+	}
+
+	go m.Shutdown()
+	if !<-waited {
+		t.Error("WaitStage should return when the last notifier of the stage has finished")
+	}
+	if err := m.WaitStageContext(context.Background(), Stage3); err != nil {
+		t.Fatal(err)
+	}
+	if !second.Load() {
+		t.Error("stage 2 should be done when stage 3 is")
+	}
+}
+
+func TestHardDeadline(t *testing.T) {
+	var mu sync.Mutex
+	var timedOut []Stage
+	m := New(WithHardDeadline(100*time.Millisecond), WithTimeout(time.Second), WithOnTimeout(func(s Stage, ctx string) {
+		mu.Lock()
+		timedOut = append(timedOut, s)
+		mu.Unlock()
+	}))
+	defer close(startTimer(m, t))
+
+	stuck := m.First("stuck")
+	go func() { <-stuck.Notify() }()
+	var called atomic.Bool
+	m.SecondFn(func() { called.Store(true) })
+	m.Third()
+
+	start := time.Now()
+	m.Shutdown()
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("shutdown took %v, want about 100ms", d)
+	}
+	if called.Load() {
+		t.Error("notifier in skipped stage was called")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []Stage{Stage1, Stage2, Stage3}
+	if len(timedOut) != len(want) {
+		t.Fatalf("want timeouts in %v, got %v", want, timedOut)
+	}
+	for i := range want {
+		if timedOut[i] != want[i] {
+			t.Errorf("want timeouts in %v, got %v", want, timedOut)
+		}
+	}
+}
+
+func TestAdaptiveTimeout(t *testing.T) {
+	var mu sync.Mutex
+	timedOut := map[Stage]bool{}
+	m := New(WithTimeout(time.Second), WithAdaptiveTimeout(20*time.Millisecond, 200*time.Millisecond),
+		WithLogger(nil), WithOnStageComplete(func(s Stage, d time.Duration, to bool) {
+			mu.Lock()
+			timedOut[s] = to
+			mu.Unlock()
+		}))
+	defer close(startTimer(m, t))
+
+	locks := []func(){m.Lock(), m.Lock()}
+	if got := m.LocksHeld(); got != 2 {
+		t.Fatalf("want 2 locks held, got %d", got)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		for _, l := range locks {
+			l()
+		}
+	}()
+	stuck := m.First("stuck")
+	go func() { <-stuck.Notify() }()
+	m.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if timedOut[StagePS] {
+		t.Error("pre shutdown stage timed out, the timeout should scale with the held locks")
+	}
+	if !timedOut[Stage1] {
+		t.Error("stage 1 should time out after the base timeout")
+	}
+	if got := m.LocksHeld(); got != 0 {
+		t.Errorf("want 0 locks held after shutdown, got %d", got)
+	}
+}
+
+func TestShutdownWithDeadline(t *testing.T) {
+	m := New(WithTimeout(time.Second))
+	defer close(startTimer(m, t))
+
+	var called atomic.Bool
+	m.FirstFn(func() { called.Store(true) })
+	m.ShutdownWithDeadline(time.Now().Add(-time.Second))
+	if called.Load() {
+		t.Error("notifier was called after the deadline")
+	}
+	if !m.Started() {
+		t.Error("shutdown should be started")
+	}
+}
+
+func TestSkipStages(t *testing.T) {
+	var rec eventRecorder
+	completed := make(chan Stage, 4)
+	m := New(WithSkipStages(StagePS, Stage3), WithLogger(rec.log), WithTimeout(time.Second),
+		WithOnStageComplete(func(s Stage, d time.Duration, timedOut bool) { completed <- s }))
+	defer close(startTimer(m, t))
+
+	if m.PreShutdownFn(func() {}).Valid() {
+		t.Error("notifier for a skipped stage should be invalid")
+	}
+	if m.Third().Valid() {
+		t.Error("notifier for a skipped stage should be invalid")
+	}
+	var called atomic.Bool
+	m.FirstFn(func() { called.Store(true) })
+	// Locks are not waited for when the pre shutdown stage is skipped.
+	l := m.Lock()
+	defer l()
+	m.Shutdown()
+
+	if !called.Load() {
+		t.Error("stage 1 was not run")
+	}
+	if !m.StageDone(StagePS) || !m.StageDone(Stage3) {
+		t.Error("skipped stages should be done")
+	}
+	close(completed)
+	for s := range completed {
+		if s == StagePS || s == Stage3 {
+			t.Errorf("completion reported for skipped stage %d", s.Index())
+		}
+	}
+	var started bool
+	for _, e := range rec.get() {
+		if e.Stage == StagePS {
+			t.Errorf("unexpected event for skipped stage: %+v", e)
+		}
+		started = started || (e.Kind == EventShutdownStarted && e.Stage == Stage1)
+	}
+	if !started {
+		t.Error("shutdown started should be logged by the first stage that runs")
+	}
+}
+
+func TestTimeoutPolicyKeepWaiting(t *testing.T) {
+	var timeouts atomic.Int32
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage1, 20*time.Millisecond), WithHardDeadline(5*time.Second),
+		WithTimeoutPolicy(KeepWaiting, Stage1), WithLogger(nil),
+		WithOnTimeout(func(s Stage, ctx string) {
+			if s == Stage1 {
+				timeouts.Add(1)
+			}
+		}))
+	defer close(startTimer(m, t))
+
+	var finished atomic.Bool
+	m.FirstFn(func() {
+		time.Sleep(100 * time.Millisecond)
+		finished.Store(true)
+	}, "slow")
+	var before bool
+	m.SecondFn(func() { before = finished.Load() })
+	m.Shutdown()
+
+	if !before {
+		t.Error("stage 2 started before the slow notifier in stage 1 finished")
+	}
+	if got := timeouts.Load(); got < 2 {
+		t.Errorf("want the timeout reported at each interval, got %d reports", got)
+	}
+}
+
+func TestTimeoutPolicyHardDeadline(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithTimeoutN(Stage1, 20*time.Millisecond), WithHardDeadline(200*time.Millisecond),
+		WithTimeoutPolicy(KeepWaiting), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	stuck := m.First("stuck")
+	go func() { <-stuck.Notify() }()
+	start := time.Now()
+	m.Shutdown()
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("shutdown returned after %v, it should keep waiting until the hard deadline", d)
+	}
+}
+
+func TestBestEffort(t *testing.T) {
+	var rec, hooked eventRecorder
+	var timeouts atomic.Int32
+	m := New(WithTimeout(time.Second), WithBestEffortTimeout(20*time.Millisecond), WithLogger(rec.log),
+		WithEventHook(hooked.log), WithOnTimeout(func(s Stage, ctx string) { timeouts.Add(1) }))
+	defer close(startTimer(m, t))
+
+	var cancelled atomic.Bool
+	release := make(chan struct{})
+	defer close(release)
+	m.ThirdCtxFn(func(ctx context.Context) {
+		<-ctx.Done()
+		cancelled.Store(true)
+		<-release
+	}, "cache", BestEffort())
+	var finished atomic.Bool
+	m.ThirdFn(func() {
+		time.Sleep(50 * time.Millisecond)
+		finished.Store(true)
+	})
+	start := time.Now()
+	m.Shutdown()
+
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("shutdown took %v, it should not wait for the stage timeout", d)
+	}
+	if !finished.Load() {
+		t.Error("shutdown did not wait for the other notifier")
+	}
+	var hooks int
+	for _, e := range hooked.get() {
+		if e.Kind == EventNotifierTimeout {
+			hooks++
+			if e.Level != LevelInfo || e.Duration < 20*time.Millisecond {
+				t.Errorf("unexpected timeout event sent to hook %+v", e)
+			}
+		}
+	}
+	if hooks != 1 {
+		t.Errorf("want best effort timeout sent to the hook once, got %d", hooks)
+	}
+	if got := timeouts.Load(); got != 0 {
+		t.Errorf("want no timeouts reported, got %d", got)
+	}
+	if got := m.Metrics().StageTimeouts; got != 0 {
+		t.Errorf("want no stage timeouts, got %d", got)
+	}
+	var logged bool
+	for _, e := range rec.get() {
+		if e.Kind == EventNotifierTimeout {
+			if e.Level != LevelInfo || !strings.Contains(e.Context, "cache") {
+				t.Errorf("unexpected timeout event %+v", e)
+			}
+			logged = true
+		}
+	}
+	if !logged {
+		t.Error("best effort timeout not logged")
+	}
+	if !cancelled.Load() {
+		t.Error("context of best effort function not cancelled")
+	}
+}
+
+func TestStageConcurrency(t *testing.T) {
+	m := New(WithTimeout(time.Second), WithStageConcurrency(Stage1, 3), WithLogger(nil))
+	defer close(startTimer(m, t))
+
+	var running, max, called atomic.Int32
+	for i := 0; i < 10; i++ {
+		m.FirstFn(func() {
+			n := running.Add(1)
+			for {
+				old := max.Load()
+				if n <= old || max.CompareAndSwap(old, n) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			running.Add(-1)
+			called.Add(1)
+		})
+	}
+	m.Shutdown()
+
+	if got := called.Load(); got != 10 {
+		t.Errorf("want 10 functions called, got %d", got)
+	}
+	if got := max.Load(); got > 3 {
+		t.Errorf("want at most 3 functions running at once, got %d", got)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"sync"
+	"time"
+)
+
+// TestingTimeout is the timeout of each stage of managers returned by NewForTesting.
+const TestingTimeout = 100 * time.Millisecond
+
+// TestingT is the part of testing.TB used by ShutdownForTesting.
+type TestingT interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+}
+
+// eventLog keeps all events it is given.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (l *eventLog) add(e Event) {
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	l.mu.Unlock()
+}
+
+func (l *eventLog) get() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
+
+// NewForTesting returns a manager for testing code that uses a manager.
+// Each stage times out after TestingTimeout, os.Exit is never called and
+// nothing is logged. Instead all events are kept, and can be read with Events.
+// The options are applied after the testing defaults, so they can be overridden.
+func NewForTesting(options ...Option) *Manager {
+	keep := func(m *Manager) { m.testEvents = &eventLog{} }
+	return New(append([]Option{keep, WithOSExit(false), WithTimeout(TestingTimeout), WithLogger(nil)}, options...)...)
+}
+
+// Events returns all events of a manager returned by NewForTesting.
+// For other managers nil is returned.
+func (m *Manager) Events() []Event {
+	if m.testEvents == nil {
+		return nil
+	}
+	return m.testEvents.get()
+}
+
+// ShutdownForTesting runs the shutdown and reports all errors,
+// like timeouts and panics, to t.
+// The manager must be returned by NewForTesting.
+func (m *Manager) ShutdownForTesting(t TestingT) {
+	t.Helper()
+	if m.testEvents == nil {
+		t.Errorf("shutdown: ShutdownForTesting called on manager not returned by NewForTesting")
+		return
+	}
+	m.Shutdown()
+	for _, e := range m.Events() {
+		if e.Level == LevelError {
+			t.Errorf("shutdown: stage %d: %s", e.Stage.n, e.String())
+		}
+	}
+}
+
+// StepShutdown runs the next stage of the shutdown and returns when it has completed,
+// so a test can check the state between stages. The first call starts the shutdown.
+// It returns true if there are more stages to run, and false when shutdown has finished
+// or has been aborted. Later calls return false.
+// Stages without notifiers and skipped stages are also run one at the time.
+// If the hard deadline is reached, the remaining stages are skipped in one step.
+// StepShutdown must not be called concurrently, and panics if the manager was not returned
+// by NewForTesting, or shutdown was started by another call.
+func (m *Manager) StepShutdown() bool {
+	if m.testEvents == nil {
+		panic("shutdown: StepShutdown called on manager not returned by NewForTesting")
+	}
+	m.sqM.Lock()
+	if m.steps == nil {
+		if m.shutdownCalled.Load() {
+			m.sqM.Unlock()
+			panic("shutdown: StepShutdown called after shutdown was started")
+		}
+		m.steps = make(chan struct{})
+		m.stepped = make(chan bool)
+		go m.Shutdown()
+	}
+	steps, stepped := m.steps, m.stepped
+	m.sqM.Unlock()
+	if m.stepsDone.Load() {
+		return false
+	}
+	steps <- struct{}{}
+	more := <-stepped
+	if !more {
+		m.stepsDone.Store(true)
+	}
+	return more
+}
+
+// waitStep reports that the previous stage has completed, and waits
+// for StepShutdown to run the next stage, if the shutdown is stepped.
+func (m *Manager) waitStep(steps chan struct{}, stepped chan bool, stage int) {
+	if steps == nil {
+		return
+	}
+	if stage > 0 {
+		stepped <- true
+	}
+	<-steps
+}
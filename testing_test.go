@@ -0,0 +1,95 @@
+// Copyright (c) 2015 Klaus Post, 2023 Eik Madsen, released under MIT License. See LICENSE file.
+
+package shutdown
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeT records errors reported by ShutdownForTesting.
+type fakeT struct {
+	errs []string
+}
+
+func (f *fakeT) Helper() {}
+
+func (f *fakeT) Errorf(format string, args ...interface{}) {
+	f.errs = append(f.errs, fmt.Sprintf(format, args...))
+}
+
+func TestNewForTesting(t *testing.T) {
+	m := NewForTesting()
+	defer close(startTimer(m, t))
+	if got := m.TimeoutN(Stage3); got != TestingTimeout {
+		t.Fatalf("want timeout %v, got %v", TestingTimeout, got)
+	}
+	var called bool
+	m.FirstFn(func() { called = true })
+	m.ShutdownForTesting(t)
+	if !called {
+		t.Fatal("function not called")
+	}
+	if len(m.Events()) == 0 {
+		t.Fatal("no events recorded")
+	}
+}
+
+func TestShutdownForTestingErrors(t *testing.T) {
+	m := NewForTesting(WithTimeoutN(Stage2, 10*time.Millisecond))
+	defer close(startTimer(m, t))
+	m.Second("stuck")
+	m.ThirdFn(func() { panic("third") })
+
+	var ft fakeT
+	m.ShutdownForTesting(&ft)
+	all := strings.Join(ft.errs, "\n")
+	if !strings.Contains(all, "stuck") {
+		t.Errorf("timeout not reported, got %q", all)
+	}
+	if !strings.Contains(all, "third") {
+		t.Errorf("panic not reported, got %q", all)
+	}
+
+	ft = fakeT{}
+	New(WithLogger(nil)).ShutdownForTesting(&ft)
+	if len(ft.errs) != 1 {
+		t.Errorf("want error for manager not created by NewForTesting, got %q", ft.errs)
+	}
+}
+
+func TestStepShutdown(t *testing.T) {
+	m := NewForTesting()
+	defer close(startTimer(m, t))
+	var called []int
+	m.FirstFn(func() { called = append(called, 1) })
+	m.SecondFn(func() { called = append(called, 2) })
+	m.ThirdFn(func() { called = append(called, 3) })
+
+	var steps int
+	for m.StepShutdown() {
+		steps++
+		if len(called) != steps-1 {
+			t.Fatalf("after %d steps want %d functions called, got %v", steps, steps-1, called)
+		}
+		if !m.StageDone(Stage{steps - 1}) || m.StageDone(Stage{steps}) {
+			t.Fatalf("after %d steps stage %d should be the last done", steps, steps-1)
+		}
+	}
+	if steps != 3 || len(called) != 3 {
+		t.Fatalf("want 3 steps before the last and 3 functions called, got %d and %v", steps, called)
+	}
+	if m.StepShutdown() {
+		t.Error("StepShutdown should return false after shutdown")
+	}
+	m.Wait()
+
+	defer func() {
+		if recover() == nil {
+			t.Error("StepShutdown should panic on a manager not returned by NewForTesting")
+		}
+	}()
+	New(WithLogger(nil)).StepShutdown()
+}